@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"moodle-backup-filler/config"
+	"moodle-backup-filler/logger"
+	"moodle-backup-filler/moodle"
+	"moodle-backup-filler/storage"
+)
+
+// listBackups returns the names of the backups in the source directory,
+// relative to it, including those in subdirectories if Recursive is set.
+// Files not selected by selectBackup are left out.  In a local source
+// directory, extracted backups are included as well, named with a trailing
+// "/".
+func listBackups() ([]string, error) {
+	if !storage.IsS3(config.Config.SourceBackupDir) {
+		infos, err := readLocalSourceDir()
+		if err != nil {
+			return nil, err
+		}
+
+		names := make([]string, 0, len(infos))
+		for name := range infos {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		return names, nil
+	}
+
+	var names []string
+	var err error
+	if config.Config.Recursive {
+		names, err = backups.ListAll(config.Config.SourceBackupDir)
+	} else {
+		names, err = backups.List(config.Config.SourceBackupDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make([]string, 0, len(names))
+	for _, name := range names {
+		if selectBackup(name) {
+			selected = append(selected, name)
+		}
+	}
+
+	return selected, nil
+}
+
+// readLocalSourceDir returns the size and modification time of the backups
+// in the local source directory selected by selectBackup, by name relative
+// to the directory, including those in subdirectories if Recursive is set.
+// Directories containing extracted backups (see moodle.IsBackupDir) are
+// backups themselves, named with a trailing "/", wherever they're found,
+// with the total size and newest modification time of everything in them
+// (see storage.Store.Stat).  Subdirectories that can't be read are logged
+// and left out.
+func readLocalSourceDir() (map[string]*storage.Info, error) {
+	dir := config.Config.SourceBackupDir
+	infos := map[string]*storage.Info{}
+
+	err := filepath.Walk(dir, func(filename string, info os.FileInfo, err error) error {
+		if filename == dir {
+			return err
+		}
+		if err != nil {
+			logger.Err.WithError(err).Warnf("Unable to read %s", filename)
+			return nil
+		}
+
+		name, err := filepath.Rel(dir, filename)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+
+		if info.IsDir() {
+			switch {
+			case strings.HasPrefix(info.Name(), "."):
+			case moodle.IsBackupDir(filename):
+				if !selectBackup(name + "/") {
+					break
+				}
+				dirInfo, err := backups.Stat(filename)
+				if err != nil {
+					logger.Err.WithError(err).Warnf("Unable to read %s", filename)
+					break
+				}
+				infos[name+"/"] = dirInfo
+			case config.Config.Recursive:
+				return nil
+			}
+			return filepath.SkipDir
+		}
+
+		if info.Mode().IsRegular() && selectBackup(name) {
+			infos[name] = &storage.Info{Size: info.Size(), ModTime: info.ModTime()}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return infos, nil
+}
+
+// selectBackup returns true if the backup name, relative to the source
+// directory, should be processed: it isn't hidden or in a hidden directory,
+// it matches one of the Include patterns (if there are any), and it doesn't
+// match any of the Exclude patterns.
+func selectBackup(name string) bool {
+	for _, part := range strings.Split(strings.TrimSuffix(name, "/"), "/") {
+		if strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+
+	if len(config.Config.Include) > 0 && !matchAny(config.Config.Include, name) {
+		return false
+	}
+
+	return !matchAny(config.Config.Exclude, name)
+}
+
+// matchAny returns true if name matches any of the glob patterns.  Patterns
+// containing a "/" are matched against the whole of name, and others
+// against its last element, so "*.mbz" matches backups at any depth.  The
+// trailing "/" of an extracted backup isn't matched.
+func matchAny(patterns []string, name string) bool {
+	name = strings.TrimSuffix(name, "/")
+	for _, pattern := range patterns {
+		subject := name
+		if !strings.Contains(pattern, "/") {
+			subject = path.Base(name)
+		}
+		if matched, _ := path.Match(pattern, subject); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// destName returns the name in the destination directory of the backup
+// name in the source directory.  Extracted backups are written as .mbz
+// files named after their directories.
+func destName(name string) string {
+	if strings.HasSuffix(name, "/") {
+		return strings.TrimSuffix(name, "/") + ".mbz"
+	}
+
+	return name
+}
+
+// vim: nolist expandtab ts=4 sw=4
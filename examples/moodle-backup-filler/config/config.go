@@ -3,18 +3,22 @@ package config
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/BurntSushi/toml"  // TOML format config file
 	"github.com/alexflint/go-arg" // command line options
 
 	"moodle-backup-filler/logger"
+	"moodle-backup-filler/storage"
 	"moodle-backup-filler/version"
 )
 
-// args and Config represent active configuration from the command line and
-// configuration file.
+// args and Config represent active configuration from the command line,
+// environment and configuration file.
 var (
 	args   cliArgs
 	Config TOMLConfig
@@ -25,13 +29,35 @@ type cliArgs struct {
 	Debug      bool
 	ConfigFile string `arg:"--config"`
 
+	LogFormat string `arg:"--log-format"`
+	LogLevel  string `arg:"--log-level"`
+	LogFile   string `arg:"--log-file"`
+
 	SourceBackupFile string `arg:"--source"`
 	DestBackupFile   string `arg:"--dest"`
 
 	SourceBackupDir string `arg:"--sourcedir"`
 	DestBackupDir   string `arg:"--destdir"`
 
+	Watch bool
+
+	Recursive bool
+	Include   []string
+	Exclude   []string
+
+	RetryFailed bool `arg:"--retry-failed"`
+	Force       bool
+	OnlyNew     bool `arg:"--only-new"`
+
 	ContentBase string
+
+	MetricsListen string `arg:"--metrics-listen"`
+
+	Progress string
+
+	// Command is an optional command; "config show" prints the effective
+	// configuration rather than filling backups.
+	Command []string `arg:"positional"`
 }
 
 func (cliArgs) Version() string {
@@ -45,51 +71,275 @@ type (
 	TOMLConfig struct {
 		Debug bool
 
+		// LogFormat is the format of log output, either "text" (the
+		// default) or "json".  LogLevel is the minimum level of messages
+		// that are logged, defaulting to "debug" if Debug is set, otherwise
+		// "info".  Logs are written to LogFile if provided, otherwise
+		// stderr.
+		LogFormat string `toml:"log_format"`
+		LogLevel  string `toml:"log_level"`
+		LogFile   string `toml:"log_file"`
+
 		// Fileless Moodle course backup to be used as input and the output
 		// file to which the hydrated backup will be written.  If not fully
 		// pathed, will be prefixed with SourceBackupDir and DestBackupDir.
+		// Either may be an s3://bucket/key URL, or "-" for stdin/stdout,
+		// and SourceBackupFile may be a directory containing an extracted
+		// backup.
 		SourceBackupFile string `toml:"source_backup_file"`
 		DestBackupFile   string `toml:"destination_backup_file"`
 
 		// Directory containing input files and directory to which output
 		// files will be written.  If SourceBackupFile is not provided, all
 		// backups in SourceBackupDir will be hydrated and written to
-		// DestBackupDir.
+		// DestBackupDir.  Either may be an s3://bucket/prefix URL.
 		SourceBackupDir string `toml:"source_backup_directory"`
 		DestBackupDir   string `toml:"destination_backup_directory"`
 
+		// Watch keeps the process running, hydrating backups as they're
+		// written to SourceBackupDir.  WatchInterval is how often (in
+		// seconds) SourceBackupDir is rescanned, and WatchSettleTime is how
+		// long (in seconds) a file must remain unchanged before it's
+		// considered fully written.
+		Watch           bool `toml:"watch"`
+		WatchInterval   int  `toml:"watch_interval"`
+		WatchSettleTime int  `toml:"watch_settle_time"`
+
+		// Recursive processes backups in subdirectories of
+		// SourceBackupDir as well, writing each to the same relative path
+		// in DestBackupDir.  Include and Exclude are glob patterns
+		// (path.Match syntax) selecting which files are processed:
+		// patterns containing a "/" are matched against the path relative
+		// to SourceBackupDir, others against the file name.  If Include
+		// is empty, every file is included.  Hidden files and directories
+		// are always skipped.
+		Recursive bool     `toml:"recursive"`
+		Include   []string `toml:"include"`
+		Exclude   []string `toml:"exclude"`
+
+		// JournalFile records the outcome of each backup processed from
+		// SourceBackupDir, so later runs can skip backups already done
+		// and retry those that failed or were interrupted.  It defaults to
+		// .moodle-backup-filler-journal.jsonl in DestBackupDir, and may be
+		// an s3:// URL.  By default, backups done or whose output exists
+		// are skipped; Force processes every backup, RetryFailed only
+		// those that failed, were deferred or were interrupted, and
+		// OnlyNew only those never attempted.
+		JournalFile string `toml:"journal_file"`
+		RetryFailed bool   `toml:"retry_failed"`
+		Force       bool   `toml:"force"`
+		OnlyNew     bool   `toml:"only_new"`
+
+		// Progress selects how progress is reported: "tty" for a status
+		// line on stderr, "log" for a log message every ProgressInterval
+		// seconds, "off", or "auto" (the default) for "tty" if stderr is
+		// an interactive terminal and "log" otherwise.
+		Progress         string `toml:"progress"`
+		ProgressInterval int    `toml:"progress_interval"`
+
+		// MetricsListen is the address (e.g. ":9100") on which to serve
+		// Prometheus metrics at /metrics.  Metrics aren't served if empty.
+		MetricsListen string `toml:"metrics_listen"`
+
 		// base URL or path for Moodle content directory
 		ContentBase string `toml:"content_base"`
 
+		// ContentProbeHash is the content hash of a file known to exist in
+		// the content source, which is read at startup to confirm that the
+		// content source is usable.  Optional.
+		ContentProbeHash string `toml:"content_probe_hash"`
+
+		// Resilience of the content source, whatever its backend.  Failed
+		// requests are retried ContentRetries times (default 2, -1 for
+		// none), waiting ContentRetryBackoff seconds (default 1) before
+		// the first retry and twice as long before each one after that.
+		// The run is stopped once ContentMaxConsecutiveFailures files in
+		// a row have failed (default 25, -1 to never stop).  Requests and
+		// bandwidth are limited to ContentRequestsPerSecond and
+		// ContentBytesPerSecond (0 for unlimited).
+		ContentRetries                int     `toml:"content_retries"`
+		ContentRetryBackoff           int     `toml:"content_retry_backoff"`
+		ContentMaxConsecutiveFailures int     `toml:"content_max_consecutive_failures"`
+		ContentRequestsPerSecond      float64 `toml:"content_requests_per_second"`
+		ContentBytesPerSecond         int64   `toml:"content_bytes_per_second"`
+
 		// S3Region is the name of the region in which the S3 bucket exists
 		S3Region string `toml:"s3_region"`
 
-		// S3Bucket is the name of the bucket from which to read files
-		S3Bucket string `toml:"-"`
-
 		// S3AssumeRoleARN is the ARN of a role that provides read access to
 		// the bucket
 		S3AssumeRoleARN string `toml:"s3_assume_role_arn"`
-	}
-)
 
-func init() {
-	if os.Getenv("GO_TEST") != "" {
-		// we're running under `go test`; ignore command line arguments.
-		return
+		// Options for assuming S3AssumeRoleARN, which may be a comma
+		// separated list of roles to chain.  S3AssumeRoleDuration is in
+		// seconds.  If S3AssumeRoleMFASerial is set and
+		// S3AssumeRoleMFAToken isn't, the MFA code is read from the
+		// terminal.
+		S3AssumeRoleExternalID  string `toml:"s3_assume_role_external_id"`
+		S3AssumeRoleSessionName string `toml:"s3_assume_role_session_name"`
+		S3AssumeRoleDuration    int    `toml:"s3_assume_role_duration"`
+		S3AssumeRoleMFASerial   string `toml:"s3_assume_role_mfa_serial"`
+		S3AssumeRoleMFAToken    string `toml:"s3_assume_role_mfa_token" secret:"true"`
+
+		// Restoring of objects archived to Glacier or Deep Archive, with
+		// S3RestoreTier (Expedited, Standard or Bulk; empty to not
+		// restore), kept for S3RestoreDays (default 7).  Backups needing
+		// them wait up to S3RestoreWait seconds, checking every
+		// S3RestorePollInterval seconds (default 60), before being
+		// deferred to a later run.  Archived objects are only looked for
+		// before a backup is read if S3RestoreScan is set, otherwise once
+		// one has been found.
+		S3RestoreTier         string `toml:"s3_restore_tier"`
+		S3RestoreScan         bool   `toml:"s3_restore_scan"`
+		S3RestoreDays         int    `toml:"s3_restore_days"`
+		S3RestoreWait         int    `toml:"s3_restore_wait"`
+		S3RestorePollInterval int    `toml:"s3_restore_poll_interval"`
+
+		// HTTP connections to the S3 bucket.  Up to S3MaxConns (default
+		// 64) are open at once and kept for reuse, and timeouts are in
+		// seconds (0 for the default).  S3Proxy and S3NoProxy default to
+		// HTTPS_PROXY and NO_PROXY; S3Proxy may include credentials.
+		S3MaxConns              int    `toml:"s3_max_conns"`
+		S3DialTimeout           int    `toml:"s3_dial_timeout"`
+		S3TLSHandshakeTimeout   int    `toml:"s3_tls_handshake_timeout"`
+		S3ResponseHeaderTimeout int    `toml:"s3_response_header_timeout"`
+		S3IdleConnTimeout       int    `toml:"s3_idle_conn_timeout"`
+		S3KeepAlive             int    `toml:"s3_keep_alive"`
+		S3DisableKeepAlives     bool   `toml:"s3_disable_keep_alives"`
+		S3Proxy                 string `toml:"s3_proxy" secret:"true"`
+		S3NoProxy               string `toml:"s3_no_proxy"`
+
+		// Azure Blob Storage credentials, used when content base is an
+		// azblob:// URL.  AzureSASToken is preferred, then AzureSharedKey,
+		// otherwise a managed identity token is used, with AzureClientID
+		// selecting a user assigned identity.  AzureEndpoint overrides the
+		// blob service URL, e.g. for the Azurite emulator.
+		AzureSASToken  string `toml:"azure_sas_token" secret:"true"`
+		AzureSharedKey string `toml:"azure_shared_key" secret:"true"`
+		AzureClientID  string `toml:"azure_client_id"`
+		AzureEndpoint  string `toml:"azure_endpoint"`
+
+		// Used when content base is a gs:// URL.  GCSCredentialsFile is
+		// the path of a Google Cloud service account JSON key file; if
+		// empty, application default credentials are used.  Objects
+		// stored with a Content-Encoding are spooled as for HTTPSpool*.
+		GCSCredentialsFile string `toml:"gcs_credentials_file"`
+		GCSSpoolMemory     int64  `toml:"gcs_spool_memory"`
+		GCSSpoolMaxSize    int64  `toml:"gcs_spool_max_size"`
+		GCSSpoolDir        string `toml:"gcs_spool_dir"`
+
+		// SSH settings used when content base is an sftp:// URL.  Keys
+		// held by an SSH agent are used as well as SFTPKeyFile if
+		// provided, and the server's host key is checked against
+		// SFTPKnownHosts (default ~/.ssh/known_hosts).  Up to
+		// SFTPMaxSessions (default 4) SFTP sessions are used at once over
+		// a single SSH connection.
+		SFTPKeyFile       string `toml:"sftp_key_file"`
+		SFTPKeyPassphrase string `toml:"sftp_key_passphrase" secret:"true"`
+		SFTPKnownHosts    string `toml:"sftp_known_hosts"`
+		SFTPMaxSessions   int    `toml:"sftp_max_sessions"`
+
+		// LocalLayouts is a comma separated list of the layouts tried in
+		// each directory when content base is local: "moodle" (aa/bb/hash,
+		// the default), "one-level" (aa/hash) or "flat" (hash).
+		LocalLayouts string `toml:"local_layouts"`
+
+		// Used when content base is an http:// or https:// URL.  Files
+		// served without a Content-Length (chunked or compressed) are held
+		// in memory up to HTTPSpoolMemory bytes, and spooled to a
+		// temporary file in HTTPSpoolDir beyond that, up to
+		// HTTPSpoolMaxSize bytes (0 for no limit).
+		HTTPSpoolMemory  int64  `toml:"http_spool_memory"`
+		HTTPSpoolMaxSize int64  `toml:"http_spool_max_size"`
+		HTTPSpoolDir     string `toml:"http_spool_dir"`
+
+		// Used when content base is a tar:// URL.  TarIndexFile is where
+		// the offsets of files in an uncompressed tarball are saved, and
+		// TarExtractDir is where a compressed tarball is extracted to.
+		// They default to the tarball's name with .index.json and .files
+		// appended.
+		TarIndexFile  string `toml:"tar_index_file"`
+		TarExtractDir string `toml:"tar_extract_dir"`
+
+		// MbzIndexFile is where the index of files in full backups is
+		// saved when content base is an mbz:// URL.  It defaults to
+		// .mbz-index.json in the first backup directory.
+		MbzIndexFile string `toml:"mbz_index_file"`
+
+		// SourceOptions are passed to the content source backend along
+		// with the options above, for backends registered outside this
+		// package that need settings of their own.
+		SourceOptions map[string]string `toml:"source_options" secret:"true"`
+
+		// BackupS3Region is the name of the region in which the S3 bucket
+		// for source and destination backups exists, defaulting to
+		// S3Region
+		BackupS3Region string `toml:"backup_s3_region"`
+
+		// BackupS3Profile is the name of a profile in the shared AWS
+		// credentials file to use for access to backups in S3.  If not
+		// provided, credentials come from the environment or EC2 instance
+		// role.
+		BackupS3Profile string `toml:"backup_s3_profile"`
+
+		// BackupS3AssumeRoleARN is the ARN of a role that provides read
+		// and write access to the bucket for backups
+		BackupS3AssumeRoleARN string `toml:"backup_s3_assume_role_arn"`
+
+		// BackupS3PartSize is the size in bytes of each part of a multipart
+		// upload of a destination backup.  At most 10,000 parts can be
+		// uploaded, so this limits the size of a backup.
+		BackupS3PartSize int64 `toml:"backup_s3_part_size"`
 	}
+)
 
+// Load populates Config from the command line, configuration file and
+// environment, exiting if they're invalid.  It's called by the command line
+// tool; packages used as a library don't depend on Config.
+func Load() {
 	arg.MustParse(&args)
 
+	// apply logging options from the command line before anything else is
+	// logged
+	Config.LogFormat, Config.LogLevel, Config.LogFile = args.LogFormat, args.LogLevel, args.LogFile
+	if err := configureLogger(); err != nil {
+		logger.Err.WithError(err).Fatalf("Unable to configure logging")
+	}
+
+	if args.ConfigFile == "" {
+		args.ConfigFile = os.Getenv(envPrefix + "CONFIG")
+	}
 	if args.ConfigFile != "" {
 		// parse configuration file
 		logger.Err.Infof("Parsing configuration file '%s'", args.ConfigFile)
-		if _, err := toml.DecodeFile(args.ConfigFile, &Config); err != nil {
+		md, err := toml.DecodeFile(args.ConfigFile, &Config)
+		if err != nil {
 			logger.Err.WithError(err).Fatalf("Parse failed")
 		}
+		recordFileOrigins(md)
 	}
 
+	// environment variables override the configuration file
+	if err := applyEnv(); err != nil {
+		logger.Err.WithError(err).Fatalf("Unable to apply configuration from environment")
+	}
+
+	// command line options override everything else
 	mutateConfig()
+	recordCLIOrigins()
+
+	switch strings.Join(args.Command, " ") {
+	case "":
+	case "config show":
+		ShowConfig(os.Stdout)
+		os.Exit(0)
+	default:
+		logger.Err.Fatalf("Unknown command '%s'", strings.Join(args.Command, " "))
+	}
+
+	if err := configureLogger(); err != nil {
+		logger.Err.WithError(err).Fatalf("Unable to configure logging")
+	}
 
 	if err := validateConfig(); err != nil {
 		logger.Err.WithError(err).Fatalf("Config failed validation checks")
@@ -104,6 +354,26 @@ func mutateConfig() {
 		Config.Debug = true
 	}
 
+	if args.LogFormat != "" {
+		Config.LogFormat = args.LogFormat
+	}
+	if Config.LogFormat == "" {
+		Config.LogFormat = "text"
+	}
+	if args.LogLevel != "" {
+		Config.LogLevel = args.LogLevel
+	}
+	if Config.LogLevel == "" {
+		if Config.Debug {
+			Config.LogLevel = "debug"
+		} else {
+			Config.LogLevel = "info"
+		}
+	}
+	if args.LogFile != "" {
+		Config.LogFile = args.LogFile
+	}
+
 	if args.SourceBackupFile != "" {
 		Config.SourceBackupFile = args.SourceBackupFile
 	}
@@ -118,36 +388,138 @@ func mutateConfig() {
 		Config.DestBackupDir = args.DestBackupDir
 	}
 
+	if args.Watch {
+		Config.Watch = true
+	}
+	if Config.WatchInterval <= 0 {
+		Config.WatchInterval = 5
+	}
+	if Config.WatchSettleTime <= 0 {
+		Config.WatchSettleTime = 30
+	}
+
+	if args.Recursive {
+		Config.Recursive = true
+	}
+	if len(args.Include) > 0 {
+		Config.Include = args.Include
+	}
+	if len(args.Exclude) > 0 {
+		Config.Exclude = args.Exclude
+	}
+
+	if args.RetryFailed {
+		Config.RetryFailed = true
+	}
+	if args.Force {
+		Config.Force = true
+	}
+	if args.OnlyNew {
+		Config.OnlyNew = true
+	}
+
+	if args.Progress != "" {
+		Config.Progress = args.Progress
+	}
+	if Config.Progress == "" {
+		Config.Progress = "auto"
+	}
+	if Config.ProgressInterval <= 0 {
+		Config.ProgressInterval = 60
+	}
+
+	if args.MetricsListen != "" {
+		Config.MetricsListen = args.MetricsListen
+	}
+
 	if args.ContentBase != "" {
 		Config.ContentBase = args.ContentBase
 	}
-	if strings.HasPrefix(Config.ContentBase, "s3://") { // S3ContentReader
-		if Config.S3Bucket == "" && len(Config.ContentBase) > 5 {
-			Config.S3Bucket = Config.ContentBase[5:]
-		}
-	} else if strings.HasPrefix(Config.ContentBase, "http://") { // HTTPContentReader
-		// ensure there's a trailing slash to avoid checking for slash when
-		// generating URLs
-		if !strings.HasSuffix(Config.ContentBase, "/") {
-			Config.ContentBase = Config.ContentBase + "/"
-		}
-	} else { // LocalContentReader
+	if Config.ContentRetries == 0 {
+		Config.ContentRetries = 2
+	}
+	if Config.ContentRetryBackoff <= 0 {
+		Config.ContentRetryBackoff = 1
+	}
+	if Config.ContentMaxConsecutiveFailures == 0 {
+		Config.ContentMaxConsecutiveFailures = 25
+	}
+
+	if Config.BackupS3Region == "" {
+		Config.BackupS3Region = Config.S3Region
+	}
+	if Config.BackupS3PartSize <= 0 {
+		Config.BackupS3PartSize = 64 * 1024 * 1024
+	}
+
+	if Config.JournalFile == "" && Config.DestBackupDir != "" {
+		Config.JournalFile = storage.Join(Config.DestBackupDir, ".moodle-backup-filler-journal.jsonl")
 	}
 
 	// make SourceBackupFile absolute if possible with the given
 	// configuration
-	if Config.SourceBackupFile != "" && !filepath.IsAbs(Config.SourceBackupFile) {
-		Config.SourceBackupFile = filepath.Join(Config.SourceBackupDir, Config.SourceBackupFile)
+	if Config.SourceBackupFile != "" && !isAbs(Config.SourceBackupFile) {
+		Config.SourceBackupFile = storage.Join(Config.SourceBackupDir, Config.SourceBackupFile)
 	}
 
 	// make DestBackupFile absolute if possible with the given configuration
-	if Config.DestBackupFile != "" && !filepath.IsAbs(Config.DestBackupFile) {
-		Config.DestBackupFile = filepath.Join(Config.DestBackupDir, Config.DestBackupFile)
+	if Config.DestBackupFile != "" && !isAbs(Config.DestBackupFile) {
+		Config.DestBackupFile = storage.Join(Config.DestBackupDir, Config.DestBackupFile)
 	}
 }
 
+// isStdio reports whether a backup file is stdin or stdout.
+func isStdio(location string) bool {
+	return location == storage.Stdio
+}
+
+// isAbs reports whether a backup file is an absolute path, S3 URL or
+// stdin/stdout.
+func isAbs(location string) bool {
+	return isStdio(location) || storage.IsS3(location) || filepath.IsAbs(location)
+}
+
+// validateS3URL confirms that an S3 URL for backups includes a bucket name.
+func validateS3URL(url string) error {
+	if bucket, _ := storage.SplitS3URL(url); bucket == "" {
+		return fmt.Errorf("'%s' does not include a bucket name", url)
+	}
+
+	return nil
+}
+
+// configureLogger applies the logging configuration to the global loggers.
+// Empty values leave the corresponding setting unchanged.
+func configureLogger() error {
+	if Config.LogFormat != "" {
+		if err := logger.SetFormat(Config.LogFormat); err != nil {
+			return err
+		}
+	}
+	if Config.LogLevel != "" {
+		if err := logger.SetLevel(Config.LogLevel); err != nil {
+			return err
+		}
+	}
+	if Config.LogFile != "" {
+		if err := logger.SetFile(Config.LogFile); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func validateConfig() error {
-	if Config.SourceBackupDir != "" {
+	for _, location := range []string{Config.SourceBackupFile, Config.DestBackupFile, Config.SourceBackupDir, Config.DestBackupDir} {
+		if storage.IsS3(location) {
+			if err := validateS3URL(location); err != nil {
+				return err
+			}
+		}
+	}
+
+	if Config.SourceBackupDir != "" && !storage.IsS3(Config.SourceBackupDir) {
 		// confirm that source directory is valid
 		fileInfo, err := os.Stat(Config.SourceBackupDir)
 		if err != nil {
@@ -157,7 +529,7 @@ func validateConfig() error {
 			return fmt.Errorf("sourcedir '%s' is not a directory", Config.SourceBackupDir)
 		}
 	}
-	if Config.DestBackupDir != "" {
+	if Config.DestBackupDir != "" && !storage.IsS3(Config.DestBackupDir) {
 		// confirm that destination directory is valid
 		fileInfo, err := os.Stat(Config.DestBackupDir)
 		if err != nil {
@@ -174,51 +546,211 @@ func validateConfig() error {
 	if Config.SourceBackupDir != "" && Config.SourceBackupFile == "" && Config.DestBackupDir == "" {
 		return fmt.Errorf("Destination directory must be provided when filling multiple files")
 	}
+	if Config.Watch && (Config.SourceBackupDir == "" || Config.DestBackupDir == "" || Config.SourceBackupFile != "") {
+		return fmt.Errorf("Watch requires sourcedir and destdir, and cannot be used with source")
+	}
+	if Config.Watch && storage.IsS3(Config.SourceBackupDir) {
+		return fmt.Errorf("Watch requires sourcedir to be a local directory")
+	}
+	for _, pattern := range append(append([]string{}, Config.Include...), Config.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid include or exclude pattern '%s': %v", pattern, err)
+		}
+	}
+
+	selections := 0
+	for _, selected := range []bool{Config.RetryFailed, Config.Force, Config.OnlyNew} {
+		if selected {
+			selections++
+		}
+	}
+	if selections > 1 {
+		return fmt.Errorf("Only one of retry-failed, force and only-new can be used")
+	}
+	if selections > 0 && Config.SourceBackupFile != "" {
+		return fmt.Errorf("retry-failed, force and only-new require sourcedir, and cannot be used with source")
+	}
+	if storage.IsS3(Config.JournalFile) {
+		if err := validateS3URL(Config.JournalFile); err != nil {
+			return err
+		}
+	}
+	if isStdio(Config.DestBackupFile) && Config.SourceBackupFile == "" {
+		return fmt.Errorf("dest '-' can only be used when filling a single file")
+	}
+	if isStdio(Config.SourceBackupFile) {
+		// a batch reading its backup from stdin is usually unattended, so
+		// don't wait for an MFA code nobody will enter
+		if Config.S3AssumeRoleMFASerial != "" && Config.S3AssumeRoleMFAToken == "" {
+			return fmt.Errorf("s3_assume_role_mfa_token must be provided with s3_assume_role_mfa_serial when source is '-', as MFA codes aren't asked for while reading the backup from stdin")
+		}
+	}
 
-	if Config.SourceBackupFile != "" {
+	if Config.SourceBackupFile != "" && !storage.IsS3(Config.SourceBackupFile) && !isStdio(Config.SourceBackupFile) {
 		// confirm that source file is valid
 		fileInfo, err := os.Stat(Config.SourceBackupFile)
 		if err != nil {
 			return err
 		}
-		if !fileInfo.Mode().IsRegular() {
-			return fmt.Errorf("source '%s' is not a file", Config.SourceBackupFile)
+		if !fileInfo.Mode().IsRegular() && !fileInfo.IsDir() {
+			return fmt.Errorf("source '%s' is not a file or an extracted backup directory", Config.SourceBackupFile)
 		}
 	}
 
+	switch Config.Progress {
+	case "auto", "tty", "log", "off":
+	default:
+		return fmt.Errorf("progress '%s' must be one of auto, tty, log or off", Config.Progress)
+	}
+
 	if Config.ContentBase == "" {
 		return fmt.Errorf("contentbase is required")
 	}
-	if strings.HasPrefix(Config.ContentBase, "s3://") {
-		// S3ContentReader requires a valid S3 bucket URL
-		// TODO: implement validation
-	} else if strings.HasPrefix(Config.ContentBase, "http://") {
-		// HTTPContentReader requires a valid HTTP URL
-		// TODO: implement validation
-	} else {
-		// LocalContentReader requires an existing local directory
-		fileInfo, err := os.Stat(Config.ContentBase)
-		if err != nil {
-			return err
-		}
-		if !fileInfo.IsDir() {
-			return fmt.Errorf("contentbase '%s' is not a directory", Config.ContentBase)
-		}
-	}
+	// the content base itself is checked by the content source backend
+	// when it's created
 
 	return nil
 }
 
+// SourceOptions returns the options for the content source backend, keyed
+// by TOML key: the source_options table, overridden by the content source
+// options above.  Numbers and booleans are formatted as strings for the
+// backend to parse.
+func SourceOptions() map[string]string {
+	opts := map[string]string{}
+	for key, value := range Config.SourceOptions {
+		opts[key] = value
+	}
+
+	opts["s3_region"] = Config.S3Region
+	opts["s3_assume_role_arn"] = Config.S3AssumeRoleARN
+	opts["s3_assume_role_external_id"] = Config.S3AssumeRoleExternalID
+	opts["s3_assume_role_session_name"] = Config.S3AssumeRoleSessionName
+	opts["s3_assume_role_duration"] = strconv.Itoa(Config.S3AssumeRoleDuration)
+	opts["s3_assume_role_mfa_serial"] = Config.S3AssumeRoleMFASerial
+	opts["s3_assume_role_mfa_token"] = Config.S3AssumeRoleMFAToken
+	opts["s3_restore_tier"] = Config.S3RestoreTier
+	opts["s3_restore_scan"] = strconv.FormatBool(Config.S3RestoreScan)
+	opts["s3_restore_days"] = strconv.Itoa(Config.S3RestoreDays)
+	opts["s3_restore_wait"] = strconv.Itoa(Config.S3RestoreWait)
+	opts["s3_restore_poll_interval"] = strconv.Itoa(Config.S3RestorePollInterval)
+	opts["s3_max_conns"] = strconv.Itoa(Config.S3MaxConns)
+	opts["s3_dial_timeout"] = strconv.Itoa(Config.S3DialTimeout)
+	opts["s3_tls_handshake_timeout"] = strconv.Itoa(Config.S3TLSHandshakeTimeout)
+	opts["s3_response_header_timeout"] = strconv.Itoa(Config.S3ResponseHeaderTimeout)
+	opts["s3_idle_conn_timeout"] = strconv.Itoa(Config.S3IdleConnTimeout)
+	opts["s3_keep_alive"] = strconv.Itoa(Config.S3KeepAlive)
+	opts["s3_disable_keep_alives"] = strconv.FormatBool(Config.S3DisableKeepAlives)
+	opts["s3_proxy"] = Config.S3Proxy
+	opts["s3_no_proxy"] = Config.S3NoProxy
+	opts["azure_sas_token"] = Config.AzureSASToken
+	opts["azure_shared_key"] = Config.AzureSharedKey
+	opts["azure_client_id"] = Config.AzureClientID
+	opts["azure_endpoint"] = Config.AzureEndpoint
+	opts["gcs_credentials_file"] = Config.GCSCredentialsFile
+	opts["gcs_spool_memory"] = strconv.FormatInt(Config.GCSSpoolMemory, 10)
+	opts["gcs_spool_max_size"] = strconv.FormatInt(Config.GCSSpoolMaxSize, 10)
+	opts["gcs_spool_dir"] = Config.GCSSpoolDir
+	opts["sftp_key_file"] = Config.SFTPKeyFile
+	opts["sftp_key_passphrase"] = Config.SFTPKeyPassphrase
+	opts["sftp_known_hosts"] = Config.SFTPKnownHosts
+	opts["sftp_max_sessions"] = strconv.Itoa(Config.SFTPMaxSessions)
+	opts["local_layouts"] = Config.LocalLayouts
+	opts["http_spool_memory"] = strconv.FormatInt(Config.HTTPSpoolMemory, 10)
+	opts["http_spool_max_size"] = strconv.FormatInt(Config.HTTPSpoolMaxSize, 10)
+	opts["http_spool_dir"] = Config.HTTPSpoolDir
+	opts["tar_index_file"] = Config.TarIndexFile
+	opts["tar_extract_dir"] = Config.TarExtractDir
+	opts["mbz_index_file"] = Config.MbzIndexFile
+
+	return opts
+}
+
+// sourceOptionKeys returns the names of the source options set, in order.
+func sourceOptionKeys() []string {
+	keys := []string{}
+	for key := range Config.SourceOptions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
 func showConfig() {
 	logger.Err.Debugf("Debug: %v", Config.Debug)
+	logger.Err.Debugf("LogFormat: %v", Config.LogFormat)
+	logger.Err.Debugf("LogLevel: %v", Config.LogLevel)
+	logger.Err.Debugf("LogFile: %v", Config.LogFile)
 	logger.Err.Debugf("SourceBackupFile: %v", Config.SourceBackupFile)
 	logger.Err.Debugf("DestBackupFile: %v", Config.DestBackupFile)
 	logger.Err.Debugf("SourceBackupDir: %v", Config.SourceBackupDir)
 	logger.Err.Debugf("DestBackupDir: %v", Config.DestBackupDir)
+	logger.Err.Debugf("Watch: %v", Config.Watch)
+	logger.Err.Debugf("WatchInterval: %v", Config.WatchInterval)
+	logger.Err.Debugf("WatchSettleTime: %v", Config.WatchSettleTime)
+	logger.Err.Debugf("Recursive: %v", Config.Recursive)
+	logger.Err.Debugf("Include: %v", Config.Include)
+	logger.Err.Debugf("Exclude: %v", Config.Exclude)
+	logger.Err.Debugf("JournalFile: %v", Config.JournalFile)
+	logger.Err.Debugf("RetryFailed: %v", Config.RetryFailed)
+	logger.Err.Debugf("Force: %v", Config.Force)
+	logger.Err.Debugf("OnlyNew: %v", Config.OnlyNew)
+	logger.Err.Debugf("Progress: %v", Config.Progress)
+	logger.Err.Debugf("ProgressInterval: %v", Config.ProgressInterval)
+	logger.Err.Debugf("MetricsListen: %v", Config.MetricsListen)
 	logger.Err.Debugf("ContentBase: %v", Config.ContentBase)
+	logger.Err.Debugf("ContentProbeHash: %v", Config.ContentProbeHash)
+	logger.Err.Debugf("ContentRetries: %v", Config.ContentRetries)
+	logger.Err.Debugf("ContentRetryBackoff: %v", Config.ContentRetryBackoff)
+	logger.Err.Debugf("ContentMaxConsecutiveFailures: %v", Config.ContentMaxConsecutiveFailures)
+	logger.Err.Debugf("ContentRequestsPerSecond: %v", Config.ContentRequestsPerSecond)
+	logger.Err.Debugf("ContentBytesPerSecond: %v", Config.ContentBytesPerSecond)
 	logger.Err.Debugf("S3Region: %v", Config.S3Region)
-	logger.Err.Debugf("S3Bucket: %v", Config.S3Bucket)
 	logger.Err.Debugf("S3AssumeRoleARN: %v", Config.S3AssumeRoleARN)
+	logger.Err.Debugf("S3AssumeRoleExternalID: %v", Config.S3AssumeRoleExternalID)
+	logger.Err.Debugf("S3AssumeRoleSessionName: %v", Config.S3AssumeRoleSessionName)
+	logger.Err.Debugf("S3AssumeRoleDuration: %v", Config.S3AssumeRoleDuration)
+	logger.Err.Debugf("S3AssumeRoleMFASerial: %v", Config.S3AssumeRoleMFASerial)
+	logger.Err.Debugf("S3AssumeRoleMFAToken set: %v", Config.S3AssumeRoleMFAToken != "")
+	logger.Err.Debugf("S3RestoreTier: %v", Config.S3RestoreTier)
+	logger.Err.Debugf("S3RestoreScan: %v", Config.S3RestoreScan)
+	logger.Err.Debugf("S3RestoreDays: %v", Config.S3RestoreDays)
+	logger.Err.Debugf("S3RestoreWait: %v", Config.S3RestoreWait)
+	logger.Err.Debugf("S3RestorePollInterval: %v", Config.S3RestorePollInterval)
+	logger.Err.Debugf("S3MaxConns: %v", Config.S3MaxConns)
+	logger.Err.Debugf("S3DialTimeout: %v", Config.S3DialTimeout)
+	logger.Err.Debugf("S3TLSHandshakeTimeout: %v", Config.S3TLSHandshakeTimeout)
+	logger.Err.Debugf("S3ResponseHeaderTimeout: %v", Config.S3ResponseHeaderTimeout)
+	logger.Err.Debugf("S3IdleConnTimeout: %v", Config.S3IdleConnTimeout)
+	logger.Err.Debugf("S3KeepAlive: %v", Config.S3KeepAlive)
+	logger.Err.Debugf("S3DisableKeepAlives: %v", Config.S3DisableKeepAlives)
+	logger.Err.Debugf("S3Proxy set: %v", Config.S3Proxy != "")
+	logger.Err.Debugf("S3NoProxy: %v", Config.S3NoProxy)
+	logger.Err.Debugf("AzureSASToken set: %v", Config.AzureSASToken != "")
+	logger.Err.Debugf("AzureSharedKey set: %v", Config.AzureSharedKey != "")
+	logger.Err.Debugf("AzureClientID: %v", Config.AzureClientID)
+	logger.Err.Debugf("AzureEndpoint: %v", Config.AzureEndpoint)
+	logger.Err.Debugf("GCSCredentialsFile: %v", Config.GCSCredentialsFile)
+	logger.Err.Debugf("GCSSpoolMemory: %v", Config.GCSSpoolMemory)
+	logger.Err.Debugf("GCSSpoolMaxSize: %v", Config.GCSSpoolMaxSize)
+	logger.Err.Debugf("GCSSpoolDir: %v", Config.GCSSpoolDir)
+	logger.Err.Debugf("SFTPKeyFile: %v", Config.SFTPKeyFile)
+	logger.Err.Debugf("SFTPKeyPassphrase set: %v", Config.SFTPKeyPassphrase != "")
+	logger.Err.Debugf("SFTPKnownHosts: %v", Config.SFTPKnownHosts)
+	logger.Err.Debugf("SFTPMaxSessions: %v", Config.SFTPMaxSessions)
+	logger.Err.Debugf("MbzIndexFile: %v", Config.MbzIndexFile)
+	logger.Err.Debugf("LocalLayouts: %v", Config.LocalLayouts)
+	logger.Err.Debugf("HTTPSpoolMemory: %v", Config.HTTPSpoolMemory)
+	logger.Err.Debugf("HTTPSpoolMaxSize: %v", Config.HTTPSpoolMaxSize)
+	logger.Err.Debugf("HTTPSpoolDir: %v", Config.HTTPSpoolDir)
+	logger.Err.Debugf("TarIndexFile: %v", Config.TarIndexFile)
+	logger.Err.Debugf("TarExtractDir: %v", Config.TarExtractDir)
+	logger.Err.Debugf("SourceOptions set: %v", sourceOptionKeys())
+	logger.Err.Debugf("BackupS3Region: %v", Config.BackupS3Region)
+	logger.Err.Debugf("BackupS3Profile: %v", Config.BackupS3Profile)
+	logger.Err.Debugf("BackupS3AssumeRoleARN: %v", Config.BackupS3AssumeRoleARN)
+	logger.Err.Debugf("BackupS3PartSize: %v", Config.BackupS3PartSize)
 }
 
 // vim: nolist noexpandtab ts=4 sw=4
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// envPrefix is prepended to the upper cased TOML key of each configuration
+// option to give the name of the environment variable that sets it, e.g.
+// MBF_CONTENT_BASE for content_base.
+const envPrefix = "MBF_"
+
+// Origins of configuration values, in increasing order of precedence.
+const (
+	originDefault = "default"
+	originFile    = "file"
+	originEnv     = "env"
+	originCLI     = "cli"
+)
+
+// origins records where the value of each configuration option came from,
+// keyed by TOML key.  Options not present were left at their defaults.
+var origins = map[string]string{}
+
+// tomlKey returns the TOML key for a TOMLConfig field, or "" if the field
+// can't be set from the configuration file.
+func tomlKey(field reflect.StructField) string {
+	key := field.Tag.Get("toml")
+	if key == "-" {
+		return ""
+	}
+	if key == "" {
+		key = strings.ToLower(field.Name)
+	}
+
+	return key
+}
+
+// envName returns the name of the environment variable for a TOML key.
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(key)
+}
+
+// recordFileOrigins records the options set by the configuration file.
+func recordFileOrigins(md toml.MetaData) {
+	t := reflect.TypeOf(Config)
+	for i := 0; i < t.NumField(); i++ {
+		key := tomlKey(t.Field(i))
+		if key != "" && md.IsDefined(key) {
+			origins[key] = originFile
+		}
+	}
+}
+
+// applyEnv sets options from MBF_* environment variables, overriding the
+// configuration file.
+func applyEnv() error {
+	v := reflect.ValueOf(&Config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := tomlKey(t.Field(i))
+		if key == "" {
+			continue
+		}
+
+		value, ok := os.LookupEnv(envName(key))
+		if !ok {
+			continue
+		}
+		if err := setField(v.Field(i), value); err != nil {
+			return fmt.Errorf("Invalid value for %s: %v", envName(key), err)
+		}
+		origins[key] = originEnv
+	}
+
+	return nil
+}
+
+// setField parses value into a configuration field.
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		// comma separated list of strings
+		parts := strings.Split(value, ",")
+		slice := reflect.MakeSlice(field.Type(), 0, len(parts))
+		for _, part := range parts {
+			if part = strings.TrimSpace(part); part != "" {
+				slice = reflect.Append(slice, reflect.ValueOf(part))
+			}
+		}
+		field.Set(slice)
+	case reflect.Map:
+		// comma separated list of key=value pairs
+		m := reflect.MakeMap(field.Type())
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part == "" {
+				continue
+			}
+			kv := strings.SplitN(part, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("'%s' is not of the form key=value", part)
+			}
+			m.SetMapIndex(reflect.ValueOf(strings.TrimSpace(kv[0])), reflect.ValueOf(strings.TrimSpace(kv[1])))
+		}
+		field.Set(m)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
+
+// recordCLIOrigins records the options set on the command line, which are
+// the cliArgs fields with non-zero values that share a name with a
+// TOMLConfig field.
+func recordCLIOrigins() {
+	argsValue := reflect.ValueOf(args)
+	configType := reflect.TypeOf(Config)
+	for i := 0; i < argsValue.NumField(); i++ {
+		name := argsValue.Type().Field(i).Name
+		field, ok := configType.FieldByName(name)
+		if !ok {
+			continue
+		}
+		value := argsValue.Field(i)
+		if key := tomlKey(field); key != "" && !reflect.DeepEqual(value.Interface(), reflect.Zero(value.Type()).Interface()) {
+			origins[key] = originCLI
+		}
+	}
+}
+
+// vim: nolist noexpandtab ts=4 sw=4
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// redacted replaces secret configuration values in ShowConfig output.
+const redacted = "REDACTED"
+
+// redactValue hides secrets in a configuration value.  Fields tagged
+// `secret:"true"` are hidden entirely, and passwords are removed from URLs.
+func redactValue(field reflect.StructField, value interface{}) interface{} {
+	if field.Tag.Get("secret") == "true" {
+		if v := reflect.ValueOf(value); (v.Kind() == reflect.String || v.Kind() == reflect.Map) && v.Len() == 0 {
+			return value
+		}
+		if m, ok := value.(map[string]string); ok {
+			// keep the names of options, which may help in spotting
+			// mistakes, but not their values
+			hidden := map[string]string{}
+			for key := range m {
+				hidden[key] = redacted
+			}
+			return hidden
+		}
+		return redacted
+	}
+
+	if s, ok := value.(string); ok {
+		if u, err := url.Parse(s); err == nil && u.User != nil {
+			if _, hasPassword := u.User.Password(); hasPassword {
+				u.User = url.UserPassword(u.User.Username(), redacted)
+				return u.String()
+			}
+		}
+	}
+
+	return value
+}
+
+// ShowConfig writes the effective configuration to w in TOML format, noting
+// the origin of each value and redacting secrets.
+func ShowConfig(w io.Writer) {
+	v := reflect.ValueOf(Config)
+	t := v.Type()
+
+	fmt.Fprintln(w, "# moodle-backup-filler effective configuration")
+	fmt.Fprintln(w, "# precedence: cli > env > file > default")
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := tomlKey(field)
+		if key == "" {
+			continue
+		}
+
+		origin, ok := origins[key]
+		if !ok {
+			origin = originDefault
+		}
+		if origin == originEnv {
+			origin = fmt.Sprintf("%s (%s)", origin, envName(key))
+		}
+
+		value := redactValue(field, v.Field(i).Interface())
+		switch value.(type) {
+		case string:
+			fmt.Fprintf(w, "%s = %q  # %s\n", key, value, origin)
+		case []string:
+			quoted := []string{}
+			for _, s := range value.([]string) {
+				quoted = append(quoted, fmt.Sprintf("%q", s))
+			}
+			fmt.Fprintf(w, "%s = [%s]  # %s\n", key, strings.Join(quoted, ", "), origin)
+		case map[string]string:
+			m := value.(map[string]string)
+			keys := []string{}
+			for k := range m {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			pairs := []string{}
+			for _, k := range keys {
+				pairs = append(pairs, fmt.Sprintf("%s = %q", k, m[k]))
+			}
+			fmt.Fprintf(w, "%s = {%s}  # %s\n", key, strings.Join(pairs, ", "), origin)
+		default:
+			fmt.Fprintf(w, "%s = %v  # %s\n", key, value, origin)
+		}
+	}
+}
+
+// vim: nolist noexpandtab ts=4 sw=4
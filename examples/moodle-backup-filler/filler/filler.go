@@ -0,0 +1,236 @@
+// Package filler populates fileless Moodle course backups with the files
+// they reference, read from a ContentSource.  It holds no global
+// configuration, so it can be used as a library as well as through the
+// moodle-backup-filler command.
+package filler
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"moodle-backup-filler/logger"
+	"moodle-backup-filler/metrics"
+	"moodle-backup-filler/moodle"
+	"moodle-backup-filler/progress"
+	"moodle-backup-filler/source"
+)
+
+// Options configures a Filler.
+type Options struct {
+	// Source provides the files referenced by backups.  Required.
+	Source source.ContentSource
+
+	// Logger receives log messages.  Defaults to logger.Err.
+	Logger *logrus.Logger
+
+	// Progress receives the progress of each backup hydrated.  Defaults
+	// to progress.Discard.
+	Progress progress.Tracker
+
+	// Metrics, if set, is where the Prometheus metrics describing
+	// hydration are registered.  They aren't registered by default.  The
+	// metrics are shared by every Filler in the process (see
+	// metrics.Register), so several Fillers may be given the same
+	// registry, and it reports on all of them.
+	Metrics prometheus.Registerer
+}
+
+// Filler hydrates fileless Moodle course backups.  A Filler may be used by
+// multiple goroutines at once.
+type Filler struct {
+	source   source.ContentSource
+	log      *logrus.Logger
+	progress progress.Tracker
+}
+
+// New returns a Filler configured by opts.
+func New(opts Options) (*Filler, error) {
+	if opts.Source == nil {
+		return nil, fmt.Errorf("No content source provided")
+	}
+
+	f := &Filler{
+		source:   opts.Source,
+		log:      opts.Logger,
+		progress: opts.Progress,
+	}
+	if f.log == nil {
+		f.log = logger.Err
+	}
+	if f.progress == nil {
+		f.progress = progress.Discard
+	}
+	if opts.Metrics != nil {
+		if err := metrics.Register(opts.Metrics); err != nil {
+			return nil, fmt.Errorf("Unable to register metrics: %v", err)
+		}
+	}
+
+	return f, nil
+}
+
+// Source returns the ContentSource files are read from.
+func (f *Filler) Source() source.ContentSource {
+	return f.source
+}
+
+// Hydrate reads the fileless backup from in and writes a gzipped tar copy of
+// it to out with all referenced files injected.  The backup may be tar.gz,
+// zip or plain tar, or if in is an open directory (an *os.File), an
+// extracted backup.  A zip backup is read in place if in is a local file
+// (an *os.File), and otherwise copied to a temporary file first.  Neither
+// in nor out is closed.  Messages are logged to
+// the entry carried by ctx (see logger.NewContext) if there is one, so
+// callers can identify the backup being processed, and cancelling ctx stops
+// hydration.  If files the backup needs aren't available from the source
+// yet, a *source.PendingError is returned, and the backup should be
+// hydrated again later.  If the source has failed too often to continue,
+// its *source.CircuitOpenError is returned.  If in isn't a Moodle backup, a
+// *moodle.NotBackupError is returned.
+func (f *Filler) Hydrate(ctx context.Context, in io.Reader, out io.Writer) (err error) {
+	ctx = logger.WithDefault(ctx, f.log)
+	ctx = progress.NewContext(ctx, f.progress)
+
+	// input setup
+	backup, err := moodle.NewBackupReader(in, nil)
+	if moodle.IsNotBackup(err) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read original backup file: %v", err)
+	}
+	defer backup.Close()
+
+	// output setup
+	gzWriter := gzip.NewWriter(out)
+	tarWriter := tar.NewWriter(gzWriter)
+
+	defer func() {
+		if cerr := tarWriter.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("Error closing tar writer: %v", cerr)
+		}
+		if cerr := gzWriter.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("Error closing gzip writer: %v", cerr)
+		}
+	}()
+
+	// every Moodle backup has a moodle_backup.xml, so an archive without
+	// one is something else
+	foundBackupXML := false
+	firstEntry := true
+
+	// process the backup
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// read from input file
+		inHeader, err := backup.Next()
+		if err == io.EOF {
+			break
+		}
+		if firstEntry && moodle.IsCorrupt(err) {
+			// e.g. a truncated .mbz, which needn't stop a batch
+			return &moodle.NotBackupError{Reason: fmt.Sprintf("unreadable archive: %v", err)}
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading from input: %v", err)
+		}
+		firstEntry = false
+
+		switch inHeader.Name {
+		case ".ARCHIVE_INDEX":
+			// The .ARCHIVE_INDEX file must be the first file in the
+			// archive, but needs to be modified to reflect the entire
+			// content of the backup which isn't known until the archive is
+			// written.  It's optional, so rather than write the entire
+			// backup to a temporary file/directory just to create this
+			// file, we leave it out.  The downside of not having an
+			// .ARCHIVE_INDEX file is that Moodle's list_files in slower and
+			// progress reporting isn't as good.
+			continue
+		case "files.xml":
+			// Inject files listed in files.xml from content source.
+			if err := moodle.ProcessFilesXML(ctx, backup, tarWriter, f.source); err != nil {
+				if source.IsPending(err) || source.IsCircuitOpen(err) {
+					return err
+				}
+				return fmt.Errorf("Failed to process files.xml: %v", err)
+			}
+		case "moodle_backup.xml":
+			// Fileless backups are marked as such in moodle_backup.xml, so
+			// we change that to indicate files are included.
+			foundBackupXML = true
+			if err := moodle.ProcessMoodleBackupXML(backup, tarWriter); err != nil {
+				return fmt.Errorf("Failed to update moodle_backup.xml: %v", err)
+			}
+		default:
+			// Copy all other files from input to output.
+			outHeader := &tar.Header{
+				Name:     inHeader.Name,
+				Size:     inHeader.Size,
+				Mode:     inHeader.Mode,
+				ModTime:  inHeader.ModTime,
+				Typeflag: inHeader.Typeflag,
+			}
+
+			if err := tarWriter.WriteHeader(outHeader); err != nil {
+				return fmt.Errorf("Failed writing file header to ouput file: %v", err)
+			}
+
+			if _, err := io.Copy(tarWriter, backup); err != nil {
+				return fmt.Errorf("Failing writing file content to output file: %v", err)
+			}
+			f.progress.EntryCopied()
+		}
+	}
+
+	if !foundBackupXML {
+		return &moodle.NotBackupError{Reason: "archive has no moodle_backup.xml"}
+	}
+
+	return nil
+}
+
+// HydrateFile hydrates the fileless backup in the local file source into
+// the local file dest, which is replaced if it exists.  If hydration fails,
+// the partially written dest file is removed.  Messages logged include the
+// name of the source file.
+func (f *Filler) HydrateFile(ctx context.Context, source, dest string) (err error) {
+	ctx = logger.WithDefault(ctx, f.log)
+	ctx = logger.NewContext(ctx, logger.FromContext(ctx).WithField("backup", source))
+
+	in, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("Unable to open original backup file: %v", err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("Unable to write new backup file: %v", err)
+	}
+
+	defer func() {
+		if cerr := out.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("Error closing output file: %v", cerr)
+		}
+		if err != nil {
+			// don't leave a truncated backup behind where it could be
+			// mistaken for a complete one
+			os.Remove(dest)
+		}
+	}()
+
+	return f.Hydrate(ctx, in, out)
+}
+
+// vim: nolist expandtab ts=4 sw=4
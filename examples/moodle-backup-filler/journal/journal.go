@@ -0,0 +1,262 @@
+// Package journal records the outcome of each backup hydrated by batch and
+// watch runs, so that later runs can tell which backups were completed, and
+// which failed, were deferred, or were interrupted part way through.
+//
+// The journal is a file of JSON lines, one per backup attempted, kept in
+// the destination directory by default.  A line is written when each backup
+// is started and again when it's finished, so a backup whose latest line
+// is "started" was interrupted, and its output shouldn't be trusted.
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"moodle-backup-filler/logger"
+	"moodle-backup-filler/storage"
+)
+
+// Statuses of backups recorded in the journal.
+const (
+	StatusStarted   = "started"    // being hydrated, or interrupted
+	StatusDone      = "done"       // hydrated successfully
+	StatusFailed    = "failed"     // hydration failed
+	StatusDeferred  = "deferred"   // files it needs weren't available yet
+	StatusNotBackup = "not-backup" // not a Moodle backup, so skipped
+)
+
+// Entry records an attempt to hydrate a backup.
+type Entry struct {
+	// Backup is the name of the backup in the source directory, which
+	// identifies it in the journal.
+	Backup string `json:"backup"`
+
+	// Dest is where the hydrated backup was written.
+	Dest string `json:"dest"`
+
+	// Status is one of the Status constants.
+	Status string `json:"status"`
+
+	// SHA-256 checksums and sizes of the fileless backup read and the
+	// hydrated backup written, recorded once the backup is finished.  The
+	// input size is also recorded when it's started.  Extracted backups
+	// have no input checksum, and their size is that of all their files.
+	InputSHA256  string `json:"input_sha256,omitempty"`
+	InputSize    int64  `json:"input_size,omitempty"`
+	OutputSHA256 string `json:"output_sha256,omitempty"`
+	OutputSize   int64  `json:"output_size,omitempty"`
+
+	// InputModTime is the modification time of the fileless backup when
+	// it was started (see storage.Store.Stat), so that later runs can tell
+	// if it has been replaced since.
+	InputModTime *time.Time `json:"input_mod_time,omitempty"`
+
+	// MissingFiles are the content hashes of files that couldn't be read
+	// from the content source, so were left out of the backup.
+	MissingFiles []string `json:"missing_files,omitempty"`
+
+	// Error describes why the backup failed or was deferred.
+	Error string `json:"error,omitempty"`
+
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// flushInterval is how often a journal in S3 is rewritten while entries are
+// being recorded.
+const flushInterval = time.Minute
+
+// Journal is an open journal.  Entries are appended to a local journal, and
+// synced to disk as they're written so that they survive a crash.  A
+// journal in S3 can't be appended to, so it's rewritten in full with the
+// entries recorded since it was last written, at most every flushInterval
+// and when it's closed.  The old journal is only replaced once the new one
+// has been uploaded, so a crash loses at most the entries not yet written,
+// and those backups are processed again by the next run.
+type Journal struct {
+	mu       sync.Mutex
+	store    *storage.Store
+	location string
+	entries  map[string]*Entry
+
+	// file is the open local journal
+	file *os.File
+
+	// lines is the content of a journal in S3, which has entries not yet
+	// written to it if dirty is true, and was last written at flushed
+	lines   bytes.Buffer
+	dirty   bool
+	flushed time.Time
+}
+
+// Open loads the journal at location, a local path or S3 URL in store,
+// creating it if it doesn't exist.
+func Open(store *storage.Store, location string) (*Journal, error) {
+	j := &Journal{
+		store:    store,
+		location: location,
+		entries:  map[string]*Entry{},
+	}
+
+	exists, err := store.Exists(location)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to check for journal '%s': %v", location, err)
+	}
+	if exists {
+		in, err := store.Open(location)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open journal '%s': %v", location, err)
+		}
+		err = j.load(in)
+		in.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read journal '%s': %v", location, err)
+		}
+	}
+
+	if !storage.IsS3(location) {
+		j.file, err = os.OpenFile(location, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open journal '%s': %v", location, err)
+		}
+		if err := j.terminate(); err != nil {
+			j.file.Close()
+			return nil, fmt.Errorf("Unable to write to journal '%s': %v", location, err)
+		}
+	}
+
+	return j, nil
+}
+
+// load reads the entries in the journal from in, keeping the latest for
+// each backup.  Lines that can't be parsed, such as one cut short by a
+// crash, are skipped.
+func (j *Journal) load(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		entry := &Entry{}
+		if err := json.Unmarshal(line, entry); err != nil || entry.Backup == "" {
+			logger.Err.WithError(err).Warnf("Skipping invalid line %d of journal '%s'", n, j.location)
+			continue
+		}
+		j.entries[entry.Backup] = entry
+
+		if storage.IsS3(j.location) {
+			j.lines.Write(line)
+			j.lines.WriteByte('\n')
+		}
+	}
+
+	return scanner.Err()
+}
+
+// terminate ends a line cut short by a crash, so that the next entry
+// isn't appended to it.
+func (j *Journal) terminate() error {
+	info, err := j.file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+
+	last := make([]byte, 1)
+	if _, err := j.file.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	_, err = j.file.Write([]byte{'\n'})
+
+	return err
+}
+
+// Last returns the latest entry for backup, or nil if it hasn't been
+// attempted.
+func (j *Journal) Last(backup string) *Entry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.entries[backup]
+}
+
+// Record writes entry to the journal.
+func (j *Journal) Record(entry *Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	copied := *entry
+	j.entries[entry.Backup] = &copied
+
+	if j.file != nil {
+		if _, err := j.file.Write(line); err != nil {
+			return fmt.Errorf("Unable to write to journal '%s': %v", j.location, err)
+		}
+		if err := j.file.Sync(); err != nil {
+			return fmt.Errorf("Unable to write to journal '%s': %v", j.location, err)
+		}
+		return nil
+	}
+
+	j.lines.Write(line)
+	j.dirty = true
+	if time.Since(j.flushed) < flushInterval {
+		return nil
+	}
+
+	return j.flush()
+}
+
+// flush writes the content of a journal in S3.
+func (j *Journal) flush() error {
+	out, err := j.store.Create(j.location)
+	if err != nil {
+		return fmt.Errorf("Unable to write journal '%s': %v", j.location, err)
+	}
+	if _, err := out.Write(j.lines.Bytes()); err != nil {
+		out.Abort()
+		return fmt.Errorf("Unable to write journal '%s': %v", j.location, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("Unable to write journal '%s': %v", j.location, err)
+	}
+	j.dirty = false
+	j.flushed = time.Now()
+
+	return nil
+}
+
+// Close closes the journal, writing any entries not yet written to a
+// journal in S3.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file != nil {
+		return j.file.Close()
+	}
+	if j.dirty {
+		return j.flush()
+	}
+
+	return nil
+}
+
+// vim: nolist expandtab ts=4 sw=4
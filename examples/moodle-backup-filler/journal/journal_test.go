@@ -0,0 +1,91 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"moodle-backup-filler/storage"
+)
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the last line was cut short by a crash
+	filename := filepath.Join(dir, "journal.jsonl")
+	lines := `{"backup":"a.mbz","dest":"out/a.mbz","status":"started","started":"2020-01-01T00:00:00Z"}
+{"backup":"b.mbz","dest":"out/b.mbz","status":"failed","error":"boom","started":"2020-01-01T00:00:00Z"}
+
+{"backup":"a.mbz","dest":"out/a.mbz","status":"done","output_size":42,"started":"2020-01-01T00:00:00Z"}
+{"backup":"b.mbz","dest":"out/b.mbz","status":"started","started":"2020-01-02T00:00:00Z"}
+{"backup":"c.mbz","dest":"out/c.mbz","sta`
+	if err := ioutil.WriteFile(filename, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := Open(storage.New(nil), filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e := j.Last("a.mbz"); e == nil || e.Status != StatusDone || e.OutputSize != 42 {
+		t.Errorf("expected a.mbz to be done with output size 42, got %+v", e)
+	}
+	if e := j.Last("b.mbz"); e == nil || e.Status != StatusStarted {
+		t.Errorf("expected b.mbz to be started, got %+v", e)
+	}
+	if e := j.Last("c.mbz"); e != nil {
+		t.Errorf("expected c.mbz not to be in journal, got %+v", e)
+	}
+
+	// the next entry isn't appended to the torn line
+	finished := time.Now().UTC()
+	if err := j.Record(&Entry{Backup: "c.mbz", Dest: "out/c.mbz", Status: StatusDone, Started: finished, Finished: &finished}); err != nil {
+		t.Fatalf("unexpected error recording: %v", err)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %v", err)
+	}
+
+	j, err = Open(storage.New(nil), filename)
+	if err != nil {
+		t.Fatalf("unexpected error reopening: %v", err)
+	}
+	defer j.Close()
+	if e := j.Last("c.mbz"); e == nil || e.Status != StatusDone || e.Finished == nil {
+		t.Errorf("expected c.mbz to be done, got %+v", e)
+	}
+	if e := j.Last("a.mbz"); e == nil || e.Status != StatusDone {
+		t.Errorf("expected a.mbz to still be done, got %+v", e)
+	}
+}
+
+func TestRecordCopies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := Open(storage.New(nil), filepath.Join(dir, "journal.jsonl"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer j.Close()
+
+	entry := &Entry{Backup: "a.mbz", Status: StatusStarted, Started: time.Now()}
+	if err := j.Record(entry); err != nil {
+		t.Fatalf("unexpected error recording: %v", err)
+	}
+	entry.Status = StatusDone
+	if e := j.Last("a.mbz"); e == nil || e.Status != StatusStarted {
+		t.Errorf("expected recorded entry to be unchanged, got %+v", e)
+	}
+}
+
+// vim: nolist expandtab ts=4 sw=4
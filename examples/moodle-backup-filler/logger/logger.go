@@ -1,6 +1,8 @@
 package logger
 
 import (
+	"context"
+	"fmt"
 	"os"
 
 	"github.com/sirupsen/logrus"
@@ -13,6 +15,12 @@ var (
 	Err *logrus.Logger = &logrus.Logger{}
 )
 
+// contextKey is the type of the key used to store a log entry in a context.
+type contextKey struct{}
+
+// logFile is the file the error log is written to, if not stderr.
+var logFile *os.File
+
 func init() {
 	Out.Out = os.Stdout
 	Out.Formatter = &logrus.TextFormatter{}
@@ -39,13 +47,89 @@ func init() {
 func UseJSONFormat() {
 	switch Out.Formatter.(type) {
 	case *logrus.JSONFormatter:
+	default:
 		Out.Formatter = &logrus.JSONFormatter{}
-		Out.Debug("Switched error log to JSON format")
+		Err.Debug("Switched request log to JSON format")
 	}
 
 	switch Err.Formatter.(type) {
 	case *logrus.JSONFormatter:
+	default:
 		Err.Formatter = &logrus.JSONFormatter{}
-		Out.Debug("Switched request log to JSON format")
+		Err.Debug("Switched error log to JSON format")
+	}
+}
+
+// SetFormat sets the log format, which must be "text" or "json".
+func SetFormat(format string) error {
+	switch format {
+	case "json":
+		UseJSONFormat()
+	case "text":
+		Out.Formatter = &logrus.TextFormatter{}
+		Err.Formatter = &logrus.TextFormatter{}
+	default:
+		return fmt.Errorf("Unknown log format '%s', must be text or json", format)
 	}
+
+	return nil
+}
+
+// SetLevel sets the level of the error log, which must be one of the level
+// names understood by logrus (debug, info, warning, error, etc).
+func SetLevel(level string) error {
+	logLevel, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	Err.Level = logLevel
+
+	return nil
+}
+
+// SetFile redirects the error log to the named file, which is appended to
+// if it already exists.
+func SetFile(filename string) error {
+	if logFile != nil && logFile.Name() == filename {
+		return nil
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	Err.Out = file
+
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = file
+
+	return nil
+}
+
+// NewContext returns a copy of ctx carrying log, so that messages logged
+// while handling a request include its fields.
+func NewContext(ctx context.Context, log *logrus.Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, log)
+}
+
+// FromContext returns the log entry carried by ctx, or an entry for Err if
+// there isn't one.
+func FromContext(ctx context.Context) *logrus.Entry {
+	if log, ok := ctx.Value(contextKey{}).(*logrus.Entry); ok {
+		return log
+	}
+
+	return logrus.NewEntry(Err)
+}
+
+// WithDefault returns ctx, carrying an entry for log if it doesn't already
+// carry one.
+func WithDefault(ctx context.Context, log *logrus.Logger) context.Context {
+	if _, ok := ctx.Value(contextKey{}).(*logrus.Entry); ok {
+		return ctx
+	}
+
+	return NewContext(ctx, logrus.NewEntry(log))
 }
@@ -5,132 +5,426 @@
 package main
 
 import (
-	"archive/tar"
-	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
-	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 
 	"moodle-backup-filler/config"
+	"moodle-backup-filler/filler"
+	"moodle-backup-filler/journal"
 	"moodle-backup-filler/logger"
+	"moodle-backup-filler/metrics"
 	"moodle-backup-filler/moodle"
+	"moodle-backup-filler/progress"
+	"moodle-backup-filler/source"
+	_ "moodle-backup-filler/source/mbz" // registers the mbz scheme
+	"moodle-backup-filler/storage"
 )
 
+// backups provides access to the source and destination backups and the
+// journal.
+var backups *storage.Store
+
 func main() {
-	if config.Config.SourceBackupFile != "" {
+	config.Load()
+
+	var err error
+	backups, err = newBackupStore()
+	if err != nil {
+		logger.Err.WithError(err).Fatal("Unable to set up access to backups in S3")
+	}
+
+	src, err := newContentSource()
+	if err != nil {
+		logger.Err.WithError(err).Fatal("Unable to set up content source")
+	}
+	src = source.NewResilientSource(src, source.ResilienceOptions{
+		Retries:                config.Config.ContentRetries,
+		RetryBackoff:           time.Duration(config.Config.ContentRetryBackoff) * time.Second,
+		MaxConsecutiveFailures: config.Config.ContentMaxConsecutiveFailures,
+		RequestsPerSecond:      config.Config.ContentRequestsPerSecond,
+		BytesPerSecond:         config.Config.ContentBytesPerSecond,
+	})
+	if err := source.Validate(context.Background(), src, config.Config.ContentProbeHash); err != nil {
+		logger.Err.WithError(err).Fatal("Content source failed validation checks")
+	}
+
+	f, err := filler.New(filler.Options{
+		Source:   src,
+		Logger:   logger.Err,
+		Progress: progress.Batch,
+		Metrics:  prometheus.DefaultRegisterer,
+	})
+	if err != nil {
+		logger.Err.WithError(err).Fatal("Unable to set up filler")
+	}
+
+	if config.Config.MetricsListen != "" {
+		metrics.Serve(config.Config.MetricsListen)
+	}
+
+	// deferred counts backups left for a later run because files they
+	// need aren't available yet
+	deferred := 0
+
+	// notBackups are files in the source directory that aren't Moodle
+	// backups, reported at the end of the run
+	notBackups := []string{}
+
+	// the journal records the outcome of each backup in the destination
+	// directory, so later runs know which to skip
+	var j *journal.Journal
+	if config.Config.SourceBackupFile == "" {
+		j, err = journal.Open(backups, config.Config.JournalFile)
+		if err != nil {
+			logger.Err.WithError(err).Fatal("Unable to open journal")
+		}
+	}
+
+	stopProgress := progress.Start(config.Config.Progress, time.Duration(config.Config.ProgressInterval)*time.Second)
+
+	if config.Config.Watch {
+		// hydrate course backups as they arrive in the source directory
+		watch(f, j)
+	} else if config.Config.SourceBackupFile != "" {
 		// hydrate a single course backup
-		hydrate(config.Config.SourceBackupFile, config.Config.DestBackupFile)
+		progress.StartBatch(1)
+		err := hydrate(f, config.Config.SourceBackupFile, config.Config.DestBackupFile, nil)
+		if source.IsPending(err) {
+			logger.Err.WithField("backup", config.Config.SourceBackupFile).WithError(err).Warn("Backup deferred, run again later")
+			deferred++
+		} else if err != nil {
+			logger.Err.WithField("backup", config.Config.SourceBackupFile).WithError(err).Fatal("Unable to fill backup")
+		}
 	} else {
 		// hydrate a directory full of course backups
-		files, err := ioutil.ReadDir(config.Config.SourceBackupDir)
+		filenames, err := listBackups()
 		if err != nil {
 			logger.Err.WithError(err).Fatalf("Unable to read directory %s", config.Config.SourceBackupDir)
 		}
+		progress.StartBatch(len(filenames))
+
+		for _, filename := range filenames {
+			sourceFile := storage.Join(config.Config.SourceBackupDir, filename)
+			dest := storage.Join(config.Config.DestBackupDir, destName(filename))
 
-		for _, file := range files {
-			filename := file.Name()
-			if filename[0] == '.' {
-				// skip hidden files
+			skip, err := skipReason(j, filename, sourceFile, dest)
+			if err != nil {
+				logger.Err.WithError(err).Fatal("Unable to decide whether to process backup")
+			}
+			if skip != "" {
+				logger.Err.WithField("backup", sourceFile).Infof("%s, skipping", skip)
+				progress.SkipBackup()
 				continue
 			}
 
-			source := filepath.Join(config.Config.SourceBackupDir, filename)
-			dest := filepath.Join(config.Config.DestBackupDir, filename)
+			err = hydrateJournaled(f, j, filename, sourceFile, dest)
+			if source.IsPending(err) {
+				logger.Err.WithField("backup", sourceFile).WithError(err).Warn("Backup deferred, run again later")
+				deferred++
+			} else if moodle.IsNotBackup(err) {
+				logger.Err.WithField("backup", sourceFile).WithError(err).Warn("Skipping file that isn't a Moodle backup")
+				notBackups = append(notBackups, filename)
+			} else if err != nil {
+				logger.Err.WithField("backup", sourceFile).WithError(err).Fatal("Unable to fill backup")
+			}
+		}
+	}
 
-			if _, err := os.Stat(dest); !os.IsNotExist(err) {
-				logger.Err.Infof("Processed backup already exists for '%s', skipping", filename)
-				continue
+	stopProgress()
+	if j != nil {
+		if err := j.Close(); err != nil {
+			logger.Err.WithError(err).Warn("Unable to close journal")
+		}
+	}
+	if err := src.Close(); err != nil {
+		logger.Err.WithError(err).Warn("Unable to close content source")
+	}
+	if len(notBackups) > 0 {
+		logger.Err.Warnf("%d files in %s aren't Moodle backups and were skipped: %s", len(notBackups), config.Config.SourceBackupDir, strings.Join(notBackups, ", "))
+	}
+	if deferred > 0 {
+		logger.Err.Warnf("%d backups deferred until the files they need are available, run again later", deferred)
+	}
+	os.Exit(exitStatus(deferred))
+}
+
+// exitDeferred is the exit status when backups were deferred, EX_TEMPFAIL
+// from sysexits.h, so that schedulers can tell a run should be repeated.
+const exitDeferred = 75
+
+// exitStatus returns the exit status of a run in which deferred backups
+// were deferred.
+func exitStatus(deferred int) int {
+	if deferred > 0 {
+		return exitDeferred
+	}
+
+	return 0
+}
+
+// newContentSource returns the ContentSource for the configured content
+// base, from the backend registered for its URL scheme.
+func newContentSource() (source.ContentSource, error) {
+	return source.New(config.Config.ContentBase, config.SourceOptions())
+}
+
+// newBackupStore returns the Store for backups, with an S3 client if any of
+// the configured locations are in S3.
+func newBackupStore() (*storage.Store, error) {
+	locations := []string{
+		config.Config.SourceBackupFile,
+		config.Config.DestBackupFile,
+		config.Config.SourceBackupDir,
+		config.Config.DestBackupDir,
+		config.Config.JournalFile,
+	}
+	for _, location := range locations {
+		if storage.IsS3(location) {
+			// pool connections as for the content source, rather than
+			// using http.DefaultClient's two idle connections
+			httpClient, err := source.NewS3HTTPClient(source.S3TransportOptions{})
+			if err != nil {
+				return nil, err
 			}
+			c, err := storage.NewS3Client(storage.S3Options{
+				Region:        config.Config.BackupS3Region,
+				Profile:       config.Config.BackupS3Profile,
+				AssumeRoleARN: config.Config.BackupS3AssumeRoleARN,
+				PartSize:      config.Config.BackupS3PartSize,
+				HTTPClient:    httpClient,
+			})
+			if err != nil {
+				return nil, err
+			}
+			return storage.New(c), nil
+		}
+	}
 
-			logger.Err.Infof("Processing %s", filename)
-			hydrate(source, dest)
+	return storage.New(nil), nil
+}
+
+// skipReason decides whether the backup name in the source directory, read
+// from sourceFile and to be written to dest, should be skipped, from the
+// journal j and the --force, --retry-failed and --only-new options.  If it
+// should, the reason is returned.
+//
+// By default, backups are skipped if the journal records them as done (or
+// as not being Moodle backups), or if they aren't in the journal but dest
+// exists (e.g. written before the journal was kept).  Backups that failed,
+// were deferred or were interrupted are processed again, as are those whose
+// size or modification time differs from that recorded, or that were
+// written somewhere else.
+func skipReason(j *journal.Journal, name, sourceFile, dest string) (string, error) {
+	last := j.Last(name)
+	switch {
+	case config.Config.Force:
+		return "", nil
+	case last != nil && config.Config.OnlyNew:
+		return fmt.Sprintf("Backup already attempted (%s)", last.Status), nil
+	case last != nil && (last.Status == journal.StatusDone || last.Status == journal.StatusNotBackup):
+		// the journal only applies if the backup is the one recorded,
+		// and was written where it would be now
+		if last.Dest != dest {
+			return "", nil
 		}
+		info, err := backups.Stat(sourceFile)
+		if err != nil {
+			return "", fmt.Errorf("Unable to check original backup '%s': %v", sourceFile, err)
+		}
+		if info.Size != last.InputSize || last.InputModTime == nil || !info.ModTime.Equal(*last.InputModTime) {
+			return "", nil
+		}
+		if last.Status == journal.StatusNotBackup {
+			return "Not a Moodle backup", nil
+		}
+		return "Backup already done", nil
+	case last != nil:
+		return "", nil
+	case config.Config.RetryFailed:
+		return "Backup hasn't failed", nil
 	}
 
-	os.Exit(0)
+	exists, err := backups.Exists(dest)
+	if err != nil {
+		return "", fmt.Errorf("Unable to check for processed backup '%s': %v", dest, err)
+	}
+	if exists {
+		return "Processed backup already exists", nil
+	}
+
+	return "", nil
 }
 
-func hydrate(source, dest string) {
-	// input file setup
-	in, err := moodle.NewBackupReader(source)
+// hydrateJournaled hydrates the backup name in the source directory like
+// hydrate, recording it in the journal j when it's started and finished.
+// An error is only returned for the journal if the backup can't be recorded
+// as started.
+func hydrateJournaled(f *filler.Filler, j *journal.Journal, name, sourceFile, dest string) error {
+	entry := &journal.Entry{
+		Backup:  name,
+		Dest:    dest,
+		Status:  journal.StatusStarted,
+		Started: time.Now(),
+	}
+	// recorded before reading, so that a backup replaced while it's being
+	// hydrated is processed again; if it can't be, hydrate fails to open
+	// it too
+	if info, err := backups.Stat(sourceFile); err == nil {
+		entry.InputSize, entry.InputModTime = info.Size, &info.ModTime
+	}
+	if err := j.Record(entry); err != nil {
+		return err
+	}
+
+	// backups in subdirectories of the source directory are written to
+	// the same subdirectories of the destination directory
+	err := storage.MakeParent(dest)
+	if err != nil {
+		err = fmt.Errorf("Unable to create destination directory: %v", err)
+	} else {
+		err = hydrate(f, sourceFile, dest, entry)
+	}
+
+	finished := time.Now()
+	entry.Finished = &finished
+	switch {
+	case source.IsPending(err):
+		entry.Status = journal.StatusDeferred
+		entry.Error = err.Error()
+	case moodle.IsNotBackup(err):
+		entry.Status = journal.StatusNotBackup
+		entry.Error = err.Error()
+	case err != nil:
+		entry.Status = journal.StatusFailed
+		entry.Error = err.Error()
+	default:
+		entry.Status = journal.StatusDone
+	}
+	if jerr := j.Record(entry); jerr != nil {
+		logger.Err.WithField("backup", sourceFile).WithError(jerr).Error("Unable to record backup in journal, it will be processed again next time")
+	}
+
+	return err
+}
+
+// hydrate reads the fileless backup sourceFile and writes a copy of it to
+// dest with all referenced files injected, using f.  Both may be local paths
+// or S3 URLs.  If hydration fails, the partially written dest file is
+// removed.  If files aren't available yet, the *source.PendingError from f
+// is returned so the backup can be deferred.  If entry isn't nil, the
+// checksums and sizes of both files and any files missing from the backup
+// are recorded in it.
+func hydrate(f *filler.Filler, sourceFile, dest string, entry *journal.Entry) (err error) {
+	log := logger.Err.WithField("backup", sourceFile)
+	log.Infof("Processing %s", sourceFile)
+
+	progress.StartBackup(sourceFile)
+	start := time.Now()
+	defer func() {
+		progress.FinishBackup()
+		duration := time.Since(start)
+		if source.IsPending(err) {
+			metrics.BackupsDeferred.Inc()
+		} else if moodle.IsNotBackup(err) {
+			metrics.NotBackups.Inc()
+		} else if err != nil {
+			metrics.BackupsFailed.Inc()
+		} else {
+			metrics.BackupsProcessed.Inc()
+			metrics.BackupDuration.Observe(duration.Seconds())
+			log.WithField("duration", duration.Seconds()).Infof("Finished %s", sourceFile)
+		}
+	}()
+
+	in, err := backups.Open(sourceFile)
 	if err != nil {
-		logger.Err.WithError(err).Fatal("Unable to read original backup file")
+		return fmt.Errorf("Unable to open original backup file: %v", err)
 	}
 	defer in.Close()
 
-	// output file setup
-	out, err := os.Create(dest)
+	out, err := backups.Create(dest)
 	if err != nil {
-		logger.Err.WithError(err).Fatal("Unable to write new backup file")
+		return fmt.Errorf("Unable to write new backup file: %v", err)
 	}
-	gzWriter := gzip.NewWriter(out)
-	tarWriter := tar.NewWriter(gzWriter)
 
 	defer func() {
-		if err := tarWriter.Close(); err != nil {
-			logger.Err.WithError(err).Error("Error closing tar writer")
-		}
-		if err := gzWriter.Close(); err != nil {
-			logger.Err.WithError(err).Error("Error closing gzip writer")
+		if err != nil {
+			// don't leave a truncated backup behind where it could be
+			// mistaken for a complete one
+			if aerr := out.Abort(); aerr != nil {
+				log.WithError(aerr).Errorf("Unable to remove incomplete output file '%s'", dest)
+			}
+			return
 		}
-		if err := out.Close(); err != nil {
-			logger.Err.WithError(err).Error("Error closing output file")
+		if cerr := out.Close(); cerr != nil {
+			err = fmt.Errorf("Error closing output file: %v", cerr)
 		}
 	}()
 
-	// process the backup
-	for {
-		// read from input file
-		inHeader, err := in.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			logger.Err.WithError(err).Fatal("Error reading from input")
-		}
-
-		switch inHeader.Name {
-		case ".ARCHIVE_INDEX":
-			// The .ARCHIVE_INDEX file must be the first file in the
-			// archive, but needs to be modified to reflect the entire
-			// content of the backup which isn't known until the archive is
-			// written.  It's optional, so rather than write the entire
-			// backup to a temporary file/directory just to create this
-			// file, we leave it out.  The downside of not having an
-			// .ARCHIVE_INDEX file is that Moodle's list_files in slower and
-			// progress reporting isn't as good.
-			continue
-		case "files.xml":
-			// Inject files listed in files.xml from content source.
-			if err := moodle.ProcessFilesXML(in, tarWriter); err != nil {
-				logger.Err.WithError(err).Fatal("Failed to process files.xml")
-			}
-		case "moodle_backup.xml":
-			// Fileless backups are marked as such in moodle_backup.xml, so
-			// we change that to indicate files are included.
-			if err := moodle.ProcessMoodleBackupXML(in, tarWriter); err != nil {
-				logger.Err.WithError(err).Fatal("Failed to update moodle_backup.xml")
-			}
-		default:
-			// Copy all other files from input to output.
-			outHeader := &tar.Header{
-				Name:     inHeader.Name,
-				Size:     inHeader.Size,
-				Mode:     inHeader.Mode,
-				ModTime:  inHeader.ModTime,
-				Typeflag: inHeader.Typeflag,
-			}
+	ctx := logger.NewContext(context.Background(), log)
+	if entry == nil {
+		return f.Hydrate(ctx, in, out)
+	}
 
-			if err := tarWriter.WriteHeader(outHeader); err != nil {
-				logger.Err.WithError(err).Fatal("Failed writing file header to ouput file")
-			}
+	missing := &moodle.MissingFiles{}
+	inSum, outSum := newChecksum(), newChecksum()
+	ctx = moodle.WithMissingFiles(ctx, missing)
 
-			if _, err := io.Copy(tarWriter, in); err != nil {
-				logger.Err.WithError(err).Fatal("Failing writing file content to output file")
-			}
+	if moodle.IsOpenDir(in) {
+		// an extracted backup is read by the filler from the open
+		// directory, so has no checksum
+		if err := f.Hydrate(ctx, in, io.MultiWriter(out, outSum)); err != nil {
+			return err
 		}
+	} else {
+		inTee := io.TeeReader(in, inSum)
+		if err := f.Hydrate(ctx, inTee, io.MultiWriter(out, outSum)); err != nil {
+			return err
+		}
+		// the checksum covers all of the input, even if hydration didn't
+		// need to read to the end of it
+		if _, err := io.Copy(ioutil.Discard, inTee); err != nil {
+			return fmt.Errorf("Unable to read original backup file: %v", err)
+		}
+		entry.InputSHA256, entry.InputSize = inSum.String(), inSum.size
 	}
+
+	entry.OutputSHA256, entry.OutputSize = outSum.String(), outSum.size
+	entry.MissingFiles = missing.List()
+
+	return nil
+}
+
+// checksum computes the SHA-256 checksum and size of the bytes written to
+// it.
+type checksum struct {
+	hash hash.Hash
+	size int64
+}
+
+func newChecksum() *checksum {
+	return &checksum{hash: sha256.New()}
+}
+
+// Write adds b to the checksum.
+func (c *checksum) Write(b []byte) (int, error) {
+	c.size += int64(len(b))
+	return c.hash.Write(b)
+}
+
+// String returns the checksum in hex.
+func (c *checksum) String() string {
+	return hex.EncodeToString(c.hash.Sum(nil))
 }
 
 // vim: nolist expandtab ts=4 sw=4
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"moodle-backup-filler/config"
+	"moodle-backup-filler/filler"
+	"moodle-backup-filler/journal"
+	"moodle-backup-filler/moodle"
+	"moodle-backup-filler/source"
+	"moodle-backup-filler/storage"
+)
+
+// pendingSource is a ContentSource whose files are all still being
+// restored, as when S3 restores don't complete within s3_restore_wait.
+type pendingSource struct{}
+
+func (pendingSource) Name() string { return "pending" }
+func (pendingSource) Close() error { return nil }
+
+func (pendingSource) Open(ctx context.Context, contentHash string) (source.ContentReader, error) {
+	return nil, &source.PendingError{ContentHashes: []string{contentHash}, Reason: "being restored"}
+}
+
+func (pendingSource) Stat(ctx context.Context, contentHash string) (*source.FileInfo, error) {
+	return nil, &source.PendingError{ContentHashes: []string{contentHash}, Reason: "being restored"}
+}
+
+func (pendingSource) Prepare(ctx context.Context, contentHashes []string) error {
+	return &source.PendingError{ContentHashes: contentHashes, Reason: "being restored"}
+}
+
+// writeFilelessBackup writes a fileless backup referencing contentHash to
+// filename.
+func writeFilelessBackup(t *testing.T, filename, contentHash string) {
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+
+	for _, f := range []struct{ name, content string }{
+		{"moodle_backup.xml", `<?xml version="1.0" encoding="UTF-8"?><moodle_backup><information><settings></settings></information></moodle_backup>`},
+		{"files.xml", fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?><files><file id="1"><contenthash>%s</contenthash></file></files>`, contentHash)},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Size: int64(len(f.content)), Mode: 0644, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHydrateDeferredExitStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moodle-backup-filler-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backups = storage.New(nil)
+	f, err := filler.New(filler.Options{Source: pendingSource{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := filepath.Join(dir, "in.mbz")
+	dest := filepath.Join(dir, "out.mbz")
+	writeFilelessBackup(t, in, "0123456789abcdef0123456789abcdef01234567")
+
+	err = hydrate(f, in, dest, nil)
+	if !source.IsPending(err) {
+		t.Fatalf("Expected a *source.PendingError, got %v", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("Deferred backup left output '%s' behind", dest)
+	}
+	if status := exitStatus(1); status != 75 {
+		t.Errorf("Exit status with a deferred backup is %d, expected 75", status)
+	}
+	if status := exitStatus(0); status != 0 {
+		t.Errorf("Exit status without deferred backups is %d, expected 0", status)
+	}
+}
+
+func TestHydrateTruncatedBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moodle-backup-filler-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backups = storage.New(nil)
+	f, err := filler.New(filler.Options{Source: pendingSource{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tgz := filepath.Join(dir, "in.mbz")
+	writeFilelessBackup(t, tgz, "0123456789abcdef0123456789abcdef01234567")
+
+	zipFile := filepath.Join(dir, "in.zip")
+	file, err := os.Create(zipFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(file)
+	w, err := zw.Create("moodle_backup.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><moodle_backup></moodle_backup>`)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	for _, in := range []string{tgz, zipFile} {
+		if err := os.Truncate(in, 30); err != nil {
+			t.Fatal(err)
+		}
+		err := hydrate(f, in, filepath.Join(dir, "out.mbz"), nil)
+		if !moodle.IsNotBackup(err) {
+			t.Errorf("Expected a *moodle.NotBackupError for truncated '%s', got %v", in, err)
+		}
+	}
+}
+
+func TestSkipReasonChangedInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moodle-backup-filler-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backups = storage.New(nil)
+	f, err := filler.New(filler.Options{Source: pendingSource{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := journal.Open(backups, filepath.Join(dir, "journal.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	in := filepath.Join(dir, "in.mbz")
+	dest := filepath.Join(dir, "out", "in.mbz")
+	if err := ioutil.WriteFile(in, []byte("not a backup"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := hydrateJournaled(f, j, "in.mbz", in, dest); err == nil {
+		t.Fatalf("Expected an error hydrating a file that isn't a backup")
+	}
+
+	if skip, err := skipReason(j, "in.mbz", in, dest); err != nil || skip == "" {
+		t.Errorf("Unchanged file not skipped (%v)", err)
+	}
+	if skip, err := skipReason(j, "in.mbz", in, filepath.Join(dir, "other", "in.mbz")); err != nil || skip != "" {
+		t.Errorf("File written somewhere else skipped: %s (%v)", skip, err)
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(in, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if skip, err := skipReason(j, "in.mbz", in, dest); err != nil || skip != "" {
+		t.Errorf("Replaced file skipped: %s (%v)", skip, err)
+	}
+}
+
+func TestReadLocalSourceDirExtractedBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moodle-backup-filler-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backups = storage.New(nil)
+	saved := config.Config.SourceBackupDir
+	config.Config.SourceBackupDir = dir
+	defer func() { config.Config.SourceBackupDir = saved }()
+
+	activity := filepath.Join(dir, "course", "activities", "forum_1")
+	if err := os.MkdirAll(activity, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "course", "moodle_backup.xml"), []byte("<moodle_backup/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	forum := filepath.Join(activity, "forum.xml")
+	if err := ioutil.WriteFile(forum, []byte("<activity/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := readLocalSourceDir()
+	if err != nil || before["course/"] == nil {
+		t.Fatalf("Extracted backup not found: %v (%v)", before, err)
+	}
+
+	// a change deep in the backup must delay hydration as much as one to
+	// the directory itself
+	later := before["course/"].ModTime.Add(time.Minute)
+	if err := os.Chtimes(forum, later, later); err != nil {
+		t.Fatal(err)
+	}
+	after, err := readLocalSourceDir()
+	if err != nil || after["course/"] == nil {
+		t.Fatalf("Extracted backup not found: %v (%v)", after, err)
+	}
+	if !after["course/"].ModTime.Equal(later) {
+		t.Errorf("Extracted backup modified %v, expected %v", after["course/"].ModTime, later)
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moodle-backup-filler-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := config.Config.SourceBackupDir
+	config.Config.SourceBackupDir = dir
+	defer func() { config.Config.SourceBackupDir = saved }()
+
+	files := map[string]*watchedFile{
+		"top.mbz":     {},
+		"sub/in.mbz":  {},
+		"course/":     {},
+		"sub/course/": {},
+	}
+	tests := []struct {
+		filename string
+		key      string
+	}{
+		{"top.mbz", "top.mbz"},
+		{"sub/in.mbz", "sub/in.mbz"},
+		{"in.mbz", ""},
+		{"course", "course/"},
+		{"course/moodle_backup.xml", "course/"},
+		{"course/activities/forum_1/forum.xml", "course/"},
+		{"sub/course/files.xml", "sub/course/"},
+		{"sub/other.mbz", ""},
+		{".hidden/top.mbz", "-"},
+		{"sub/.in.mbz.part", "-"},
+	}
+	for _, test := range tests {
+		name, ok := watchName(filepath.Join(dir, filepath.FromSlash(test.filename)))
+		if !ok {
+			if test.key != "-" {
+				t.Errorf("%s: unexpectedly ignored", test.filename)
+			}
+			continue
+		}
+		if key := watchedKey(files, name); key != test.key {
+			t.Errorf("%s: expected key %q, got %q", test.filename, test.key, key)
+		}
+	}
+
+	// notifications cover subdirectories, but not hidden ones
+	if err := os.MkdirAll(filepath.Join(dir, "sub", ".hidden"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Skipf("Filesystem notifications unavailable: %v", err)
+	}
+	defer watcher.Close()
+	if err := watchDirs(watcher, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sub", "in.mbz"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-watcher.Events:
+		if name, _ := watchName(event.Name); name != "sub/in.mbz" {
+			t.Errorf("Expected event for sub/in.mbz, got %s", event.Name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("No event for file in subdirectory")
+	}
+}
+
+// vim: nolist expandtab ts=4 sw=4
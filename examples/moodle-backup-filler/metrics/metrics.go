@@ -0,0 +1,178 @@
+// Package metrics provides Prometheus metrics describing the progress of
+// long running batch and watch jobs, and an optional HTTP listener from
+// which they can be scraped.  Metrics are only exported once registered
+// with Register.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"moodle-backup-filler/logger"
+)
+
+const namespace = "moodle_backup_filler"
+
+// Metrics exported by moodle-backup-filler.
+var (
+	// BackupsProcessed and BackupsFailed count backups that were
+	// successfully hydrated and those that failed.
+	BackupsProcessed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backups_processed_total",
+		Help:      "Number of backups successfully hydrated.",
+	})
+	BackupsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backups_failed_total",
+		Help:      "Number of backups that failed to hydrate.",
+	})
+
+	// BackupDuration measures the time taken to hydrate each backup.
+	BackupDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "backup_duration_seconds",
+		Help:      "Time taken to hydrate a backup.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 16),
+	})
+
+	// FilesInjected and FilesMissing count files listed in files.xml that
+	// were added to backups and those that couldn't be read from the
+	// content source.
+	FilesInjected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "files_injected_total",
+		Help:      "Number of files injected into backups.",
+	})
+	FilesMissing = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "files_missing_total",
+		Help:      "Number of files that couldn't be read from the content source.",
+	})
+
+	// ContentLookups counts files listed in files.xml by how their content
+	// was found: read from the content source ("source"), already added
+	// earlier in the same backup ("duplicate"), or the empty file, which
+	// needs no reading ("empty").
+	ContentLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "content_lookups_total",
+		Help:      "Number of files listed in backups, by whether they were read from the content source, duplicates or empty.",
+	}, []string{"result"})
+
+	// SourceRequests and SourceBytes count requests made to and bytes read
+	// from each content source backend.
+	SourceRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "source_requests_total",
+		Help:      "Number of files requested from the content source, by backend and result.",
+	}, []string{"backend", "result"})
+	SourceBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "source_bytes_total",
+		Help:      "Number of bytes read from the content source, by backend.",
+	}, []string{"backend"})
+
+	// SourceRetries counts requests to each content source backend that
+	// were retried after failing.
+	SourceRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "source_retries_total",
+		Help:      "Number of content source requests retried after failing, by backend.",
+	}, []string{"backend"})
+
+	// S3TTFB measures the time to first byte of S3 GetObject requests, and
+	// S3Retries and S3Timeouts count requests made with GetObjectWithRetry
+	// that were retried after exceeding the TTFB timeout and those that ran
+	// out of retries.  The S3 content source leaves retries to
+	// ResilientSource, so they're counted by SourceRetries instead.
+	S3TTFB = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "s3_ttfb_seconds",
+		Help:      "Time to first byte of S3 GetObject requests.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	})
+	S3Retries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_retries_total",
+		Help:      "Number of S3 GetObject requests retried after exceeding the TTFB timeout.",
+	})
+	S3Timeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_timeouts_total",
+		Help:      "Number of S3 GetObject requests that exceeded the TTFB timeout on every attempt.",
+	})
+
+	// S3RestoresRequested counts restores of archived objects requested,
+	// and BackupsDeferred counts backups left for a later run because
+	// files they need aren't available yet.
+	S3RestoresRequested = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_restores_requested_total",
+		Help:      "Number of restores of archived S3 objects requested.",
+	})
+	BackupsDeferred = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backups_deferred_total",
+		Help:      "Number of backups deferred until files they need are available.",
+	})
+
+	// NotBackups counts files in the source directory that were skipped
+	// because they aren't Moodle backups.
+	NotBackups = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "not_backups_total",
+		Help:      "Number of files skipped because they aren't Moodle backups.",
+	})
+)
+
+// Register registers the metrics with r, so they can be served.  The
+// metrics are global, describing every Filler and content source in the
+// process, so they only need registering once, but registering them with
+// the same r again is harmless.  An error is returned if r already has
+// other metrics with the same names.
+func Register(r prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		BackupsProcessed,
+		BackupsFailed,
+		BackupDuration,
+		FilesInjected,
+		FilesMissing,
+		ContentLookups,
+		SourceRequests,
+		SourceBytes,
+		SourceRetries,
+		S3TTFB,
+		S3Retries,
+		S3Timeouts,
+		S3RestoresRequested,
+		BackupsDeferred,
+		NotBackups,
+	} {
+		if err := r.Register(c); err != nil {
+			if are, ok := err.(prometheus.AlreadyRegisteredError); !ok || are.ExistingCollector != c {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Serve starts an HTTP listener on addr in the background, exposing
+// metrics registered with the default registry at /metrics.
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		logger.Err.Infof("Serving metrics on %s/metrics", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Err.WithError(err).Error("Metrics listener failed")
+		}
+	}()
+}
+
+// vim: nolist expandtab ts=4 sw=4
@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRegisterTwice(t *testing.T) {
+	r := prometheus.NewRegistry()
+	if err := Register(r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := Register(r); err != nil {
+		t.Errorf("unexpected error registering again: %v", err)
+	}
+}
+
+func TestRegisterConflict(t *testing.T) {
+	r := prometheus.NewRegistry()
+	r.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backups_processed_total",
+		Help:      "Number of backups successfully hydrated.",
+	}))
+	if err := Register(r); err == nil {
+		t.Errorf("expected error registering over another collector")
+	}
+}
+
+// vim: nolist expandtab ts=4 sw=4
@@ -2,10 +2,17 @@ package moodle
 
 import (
 	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/beevik/etree" // for working with XML files
@@ -39,33 +46,139 @@ type BackupReader interface {
 	Close() error
 }
 
+// NotBackupError is returned for input that isn't a Moodle backup, such as
+// a stray text file or an unrelated archive.
+type NotBackupError struct {
+	Reason string
+}
+
+func (e *NotBackupError) Error() string {
+	return fmt.Sprintf("Not a Moodle backup: %s", e.Reason)
+}
+
+// IsNotBackup returns true if err is a *NotBackupError.
+func IsNotBackup(err error) bool {
+	_, ok := err.(*NotBackupError)
+	return ok
+}
+
+// IsCorrupt returns true if err, from reading a backup, means the backup is
+// truncated or otherwise isn't a valid archive, rather than that it
+// couldn't be read.
+func IsCorrupt(err error) bool {
+	switch err.(type) {
+	case flate.CorruptInputError:
+		return true
+	}
+
+	switch err {
+	case io.ErrUnexpectedEOF, gzip.ErrHeader, gzip.ErrChecksum, tar.ErrHeader, zip.ErrFormat, zip.ErrAlgorithm, zip.ErrChecksum:
+		return true
+	}
+
+	return false
+}
+
+// IsOpenDir reports whether in is an open directory (an *os.File), which
+// NewBackupReader reads as an extracted backup.
+func IsOpenDir(in io.Reader) bool {
+	file, ok := in.(*os.File)
+	if !ok {
+		return false
+	}
+	fileInfo, err := file.Stat()
+
+	return err == nil && fileInfo.IsDir()
+}
+
 // NewBackupReader creates and populates a new BackupReader object of the
-// appropriate type for the file passed as input.
-func NewBackupReader(filename string) (BackupReader, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, err
+// appropriate type for the backup read from in.  The file type is detected
+// from the first few bytes of in, which are buffered rather than re-read, so
+// in needn't be seekable, though a zip backup is read in place if in is a
+// local file and otherwise copied to a temporary file first.  Backups may
+// be tar.gz, zip or plain tar, or if in is an open directory (see
+// IsOpenDir), an extracted backup.  closer, which may be nil, is closed
+// when the BackupReader is closed, or immediately if an error is returned.
+// Input that isn't a backup, or is a truncated or corrupt archive, results
+// in a *NotBackupError.
+func NewBackupReader(in io.Reader, closer io.Closer) (backupReader BackupReader, err error) {
+	defer func() {
+		if err != nil && closer != nil {
+			closer.Close()
+		}
+	}()
+
+	if IsOpenDir(in) {
+		return NewDirBackupReader(in.(*os.File).Name(), closer)
 	}
 
+	buffered := bufio.NewReaderSize(in, 512)
+
 	// determine file type for input file
-	header := make([]byte, 512)
-	n, err := file.Read(header)
+	header, err := buffered.Peek(512)
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
-	file.Seek(0, 0)
 
-	fileType := http.DetectContentType(header[:n])
+	fileType := http.DetectContentType(header)
 
 	// create an appropriate BackupFile object
 	switch fileType {
 	case "application/x-gzip":
-		return NewTgzBackupReader(file)
+		backupReader, err = NewTgzBackupReader(buffered, closer)
 	case "application/zip":
-		return NewZipBackupReader(file)
+		// the zip reader needs random access, so is given a local file
+		// to read in place rather than the buffered input
+		if file, ok := seekableFile(in); ok {
+			backupReader, err = NewZipBackupReader(file, closer)
+		} else {
+			backupReader, err = NewZipBackupReader(buffered, closer)
+		}
+	default:
+		if isTarHeader(header) {
+			backupReader, err = NewTarBackupReader(buffered, closer)
+			break
+		}
+		err = &NotBackupError{Reason: fmt.Sprintf("unsupported file type %s", fileType)}
+	}
+	if IsCorrupt(err) {
+		err = &NotBackupError{Reason: fmt.Sprintf("unreadable %s archive: %v", fileType, err)}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return backupReader, nil
+}
+
+// isTarHeader reports whether header is the start of a tar file.  Tar has
+// no reliable magic number (http.DetectContentType doesn't recognise it),
+// so the first header block is checked for the ustar magic of POSIX and GNU
+// tar, or failing that, a valid header checksum.
+func isTarHeader(header []byte) bool {
+	if len(header) < 512 {
+		return false
+	}
+	if bytes.HasPrefix(header[257:], []byte("ustar")) {
+		return true
+	}
+
+	// the checksum is the sum of the header's bytes, with the checksum
+	// field itself counted as spaces, stored as octal
+	field := strings.Trim(string(header[148:156]), " \x00")
+	checksum, err := strconv.ParseInt(field, 8, 64)
+	if err != nil || field == "" {
+		return false
+	}
+	var sum int64
+	for i, b := range header[:512] {
+		if i >= 148 && i < 156 {
+			b = ' '
+		}
+		sum += int64(b)
 	}
 
-	return nil, fmt.Errorf("Unsupported input file type %s", fileType)
+	return sum == checksum
 }
 
 // ProcessMoodleBackupXML copies the moodle_backup.xml file from in to out,
@@ -0,0 +1,132 @@
+package moodle
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// DirBackupReader implements the BackupReader interface for Moodle course
+// backups that have already been extracted to a directory, such as those
+// left in Moodle's backup/temp directory.
+type DirBackupReader struct {
+	dir     string
+	names   []string
+	next    int
+	current *os.File
+	closer  io.Closer
+}
+
+// IsBackupDir reports whether dir is an extracted Moodle course backup,
+// i.e. a directory containing moodle_backup.xml.
+func IsBackupDir(dir string) bool {
+	fileInfo, err := os.Stat(filepath.Join(dir, "moodle_backup.xml"))
+	return err == nil && fileInfo.Mode().IsRegular()
+}
+
+// NewDirBackupReader returns a DirBackupReader object for the extracted
+// backup in dir, with closer (which may be nil) being closed when the
+// DirBackupReader is closed.  Returns a *NotBackupError if dir doesn't look
+// like a Moodle course backup.
+//
+// Entries are returned in lexical order, directories before their
+// contents, with names relative to dir as they would be in a zip or tar
+// backup.
+func NewDirBackupReader(dir string, closer io.Closer) (BackupReader, error) {
+	if !IsBackupDir(dir) {
+		return nil, &NotBackupError{Reason: "directory has no moodle_backup.xml"}
+	}
+
+	br := &DirBackupReader{
+		dir:    dir,
+		closer: closer,
+	}
+	err := filepath.Walk(dir, func(filename string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if filename == dir || !(fileInfo.IsDir() || fileInfo.Mode().IsRegular()) {
+			return nil
+		}
+
+		name, err := filepath.Rel(dir, filename)
+		if err != nil {
+			return err
+		}
+		br.names = append(br.names, filepath.ToSlash(name))
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return br, nil
+}
+
+// Next advances to the next entry in an extracted Moodle backup.
+func (br *DirBackupReader) Next() (*FileHeader, error) {
+	if br.current != nil {
+		br.current.Close()
+		br.current = nil
+	}
+	if br.next >= len(br.names) {
+		return nil, io.EOF
+	}
+
+	name := br.names[br.next]
+	br.next++
+
+	file, err := os.Open(filepath.Join(br.dir, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	header := &FileHeader{
+		Name:     name,
+		Size:     fileInfo.Size(),
+		Mode:     int64(fileInfo.Mode().Perm()),
+		ModTime:  fileInfo.ModTime(),
+		Typeflag: tar.TypeReg,
+	}
+	if fileInfo.IsDir() {
+		file.Close()
+		header.Name += "/"
+		header.Size = 0
+		header.Typeflag = tar.TypeDir
+		return header, nil
+	}
+	br.current = file
+
+	return header, nil
+}
+
+// Read reads from the current file in an extracted Moodle backup.
+func (br *DirBackupReader) Read(b []byte) (int, error) {
+	if br.current == nil {
+		return 0, io.EOF
+	}
+
+	return br.current.Read(b)
+}
+
+// Close closes the current file and the input.
+func (br *DirBackupReader) Close() error {
+	if br.current != nil {
+		br.current.Close()
+		br.current = nil
+	}
+	if br.closer == nil {
+		return nil
+	}
+
+	return br.closer.Close()
+}
+
+// vim: nolist expandtab ts=4 sw=4
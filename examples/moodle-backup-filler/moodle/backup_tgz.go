@@ -3,38 +3,58 @@ package moodle
 import (
 	"archive/tar"
 	"compress/gzip"
-	"os"
+	"io"
+	"strings"
 )
 
-// TgzBackupReader implements the BackupReader interface for tar.gz
-// formatted Moodle course backups.
+// TgzBackupReader implements the BackupReader interface for tar.gz (and
+// plain tar) formatted Moodle course backups.
 type TgzBackupReader struct {
 	reader *tar.Reader
-	file   *os.File
+	closer io.Closer
 }
 
 // NewTgzBackupReader returns a TgzBackupReader object initialised with the
-// configured input file.  Returns an error if the file is not a gzipped tar
-// file or the contents of the file don't look like a Moodle course backup.
-func NewTgzBackupReader(file *os.File) (BackupReader, error) {
-	gzipReader, err := gzip.NewReader(file)
+// input read from in, with closer (which may be nil) being closed when the
+// TgzBackupReader is closed.  Returns an error if the input is not a
+// gzipped tar file or the contents of the file don't look like a Moodle
+// course backup.
+func NewTgzBackupReader(in io.Reader, closer io.Closer) (BackupReader, error) {
+	gzipReader, err := gzip.NewReader(in)
 	if err != nil {
 		return nil, err
 	}
 	tarReader := tar.NewReader(gzipReader)
 
 	return &TgzBackupReader{
-		file:   file,
+		closer: closer,
 		reader: tarReader,
 	}, nil
 }
 
-// Next advances to the next entry in a tar formatted Moodle backup.
+// NewTarBackupReader returns a BackupReader for an uncompressed tar
+// formatted Moodle course backup read from in, with closer (which may be
+// nil) being closed when it's closed.  Once decompressed, a tar.gz backup
+// is read the same way, so this is a TgzBackupReader without the gzip
+// layer.
+func NewTarBackupReader(in io.Reader, closer io.Closer) (BackupReader, error) {
+	return &TgzBackupReader{
+		closer: closer,
+		reader: tar.NewReader(in),
+	}, nil
+}
+
+// Next advances to the next entry in a tar formatted Moodle backup.  Tars
+// created with "tar cf backup.tar ." name their entries with a leading
+// "./", which is removed, and their "./" entry is skipped.
 func (br *TgzBackupReader) Next() (header *FileHeader, err error) {
 	tarHeader, tarErr := br.reader.Next()
+	for tarErr == nil && (tarHeader.Name == "./" || tarHeader.Name == ".") {
+		tarHeader, tarErr = br.reader.Next()
+	}
 	if tarErr == nil {
 		header = &FileHeader{
-			Name:     tarHeader.Name,
+			Name:     strings.TrimPrefix(tarHeader.Name, "./"),
 			Size:     tarHeader.Size,
 			Mode:     tarHeader.Mode,
 			ModTime:  tarHeader.ModTime,
@@ -51,9 +71,13 @@ func (br *TgzBackupReader) Read(b []byte) (int, error) {
 	return br.reader.Read(b)
 }
 
-// Close closes the open file.
+// Close closes the input.
 func (br *TgzBackupReader) Close() error {
-	return br.file.Close()
+	if br.closer == nil {
+		return nil
+	}
+
+	return br.closer.Close()
 }
 
 // vim: nolist expandtab ts=4 sw=4
@@ -1,45 +1,148 @@
 package moodle
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"io/ioutil"
 	"os"
-
-	"moodle-backup-filler/logger"
 )
 
 // ZipBackupReader implements the BackupReader interface for zip formatted
 // Moodle course backups.
 type ZipBackupReader struct {
-	file *os.File
+	files   []*zip.File
+	next    int
+	current io.ReadCloser
+	closer  io.Closer
+
+	// spool is a temporary copy of the input, if it couldn't be read in
+	// place
+	spool *os.File
 }
 
 // NewZipBackupReader returns a ZipBackupReader object initialised with the
-// configured input file.  Returns an error if the file is not a zip file or
-// the contents of the file don't look like a Moodle course backup.
-func NewZipBackupReader(file *os.File) (BackupReader, error) {
-	return &ZipBackupReader{
-		file: file,
-	}, nil
+// input read from in, with closer (which may be nil) being closed when the
+// ZipBackupReader is closed.  Returns an error if the input is not a zip
+// file or the contents of the file don't look like a Moodle course backup.
+//
+// The zip format keeps its index at the end of the file, so if in isn't a
+// local file that can be read in place, it's first copied to a temporary
+// file.
+func NewZipBackupReader(in io.Reader, closer io.Closer) (BackupReader, error) {
+	br := &ZipBackupReader{
+		closer: closer,
+	}
+
+	file, ok := seekableFile(in)
+	if !ok {
+		spool, err := ioutil.TempFile("", "moodle-backup-filler-zip")
+		if err != nil {
+			return nil, err
+		}
+		os.Remove(spool.Name()) // removed once closed
+		if _, err := io.Copy(spool, in); err != nil {
+			spool.Close()
+			return nil, err
+		}
+		br.spool = spool
+		file = spool
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		br.closeSpool()
+		return nil, err
+	}
+
+	zipReader, err := zip.NewReader(file, fileInfo.Size())
+	if err != nil {
+		br.closeSpool()
+		return nil, err
+	}
+	br.files = zipReader.File
+
+	return br, nil
+}
+
+// closeSpool closes (and so removes) the temporary copy of the input, if
+// there is one.
+func (br *ZipBackupReader) closeSpool() {
+	if br.spool != nil {
+		br.spool.Close()
+		br.spool = nil
+	}
 }
 
 // Next advances to the next entry in a zip formatted Moodle backup.
 func (br *ZipBackupReader) Next() (*FileHeader, error) {
-	// TODO: implement this
-	logger.Err.Fatal("Zip formatted Moodle backups are not currently supported")
+	if br.current != nil {
+		br.current.Close()
+		br.current = nil
+	}
+	if br.next >= len(br.files) {
+		return nil, io.EOF
+	}
 
-	return nil, nil
+	file := br.files[br.next]
+	br.next++
+
+	current, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	br.current = current
+
+	header := &FileHeader{
+		Name:     file.Name,
+		Size:     int64(file.UncompressedSize64),
+		Mode:     int64(file.Mode().Perm()),
+		ModTime:  file.ModTime(),
+		Typeflag: tar.TypeReg,
+	}
+	if file.Mode().IsDir() {
+		header.Size = 0
+		header.Typeflag = tar.TypeDir
+	}
+
+	return header, nil
 }
 
 // Read reads from the current file in a zip formatted Moodle backup.
 func (br *ZipBackupReader) Read(b []byte) (int, error) {
-	// TODO: implement this
-	logger.Err.Fatal("Zip formatted Moodle backups are not currently supported")
+	if br.current == nil {
+		return 0, io.EOF
+	}
 
-	return 0, nil
+	return br.current.Read(b)
 }
 
-// Close closes the open file.
+// Close closes the input.
 func (br *ZipBackupReader) Close() error {
-	return br.file.Close()
+	if br.current != nil {
+		br.current.Close()
+		br.current = nil
+	}
+	br.closeSpool()
+	if br.closer == nil {
+		return nil
+	}
+
+	return br.closer.Close()
+}
+
+// seekableFile returns in if it's a local file that can be read in place
+// from the start, rather than e.g. stdin or a pipe.
+func seekableFile(in io.Reader) (*os.File, bool) {
+	file, ok := in.(*os.File)
+	if !ok {
+		return nil, false
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, false
+	}
+
+	return file, true
 }
 
 // vim: nolist expandtab ts=4 sw=4
@@ -0,0 +1,80 @@
+package moodle
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeZipBackup writes a zip backup containing moodle_backup.xml to
+// filename.
+func writeZipBackup(t *testing.T, filename string) {
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(file)
+	w, err := zw.Create("moodle_backup.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><moodle_backup/>`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestZipBackupInPlace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moodle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "backup.zip")
+	writeZipBackup(t, filename)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	tests := []struct {
+		name    string
+		in      io.Reader
+		spooled bool
+	}{
+		{"file", file, false},
+		{"reader", bytes.NewReader(data), true},
+	}
+	for _, test := range tests {
+		br, err := NewBackupReader(test.in, nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if spooled := br.(*ZipBackupReader).spool != nil; spooled != test.spooled {
+			t.Errorf("%s: expected spooled to be %v", test.name, test.spooled)
+		}
+		header, err := br.Next()
+		if err != nil || header.Name != "moodle_backup.xml" {
+			t.Errorf("%s: expected moodle_backup.xml, got %v (%v)", test.name, header, err)
+		}
+		br.Close()
+	}
+}
+
+// vim: nolist expandtab ts=4 sw=4
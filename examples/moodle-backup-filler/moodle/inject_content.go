@@ -3,34 +3,111 @@ package moodle
 import (
 	"archive/tar"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/beevik/etree"
+	"github.com/sirupsen/logrus"
 
 	"moodle-backup-filler/logger"
+	"moodle-backup-filler/metrics"
+	"moodle-backup-filler/progress"
 	"moodle-backup-filler/source"
 )
 
-func injectFile(contentHash string, out *tar.Writer) error {
+// emptyContentHash is the content hash of the empty file, which isn't read
+// from the content source.
+const emptyContentHash = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+
+// MissingFiles collects the content hashes of files that couldn't be read
+// from the content source, so were left out of a backup.
+type MissingFiles struct {
+	mu     sync.Mutex
+	hashes []string
+}
+
+// missingFilesKey is the context key for a *MissingFiles.
+type missingFilesKey struct{}
+
+// WithMissingFiles returns a copy of ctx carrying missing, to which files
+// left out of the backup being processed are added.
+func WithMissingFiles(ctx context.Context, missing *MissingFiles) context.Context {
+	return context.WithValue(ctx, missingFilesKey{}, missing)
+}
+
+// List returns the content hashes of the files left out.
+func (m *MissingFiles) List() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]string(nil), m.hashes...)
+}
+
+// recordMissing adds contentHash to the MissingFiles carried by ctx, if
+// there is one.
+func recordMissing(ctx context.Context, contentHash string) {
+	m, ok := ctx.Value(missingFilesKey{}).(*MissingFiles)
+	if !ok {
+		return
+	}
+
+	m.mu.Lock()
+	m.hashes = append(m.hashes, contentHash)
+	m.mu.Unlock()
+}
+
+func injectFile(ctx context.Context, src source.ContentSource, contentHash string, out *tar.Writer) error {
+	log := logger.FromContext(ctx).WithFields(logrus.Fields{
+		"contenthash": contentHash,
+		"source":      src.Name(),
+	})
+	ctx = logger.NewContext(ctx, log)
+	start := time.Now()
+	defer progress.FromContext(ctx).FileInjected()
+
 	var reader io.Reader
 	var size int64
 
-	if contentHash == "da39a3ee5e6b4b0d3255bfef95601890afd80709" {
+	if contentHash == emptyContentHash {
 		// special handling for the empty file
+		metrics.ContentLookups.WithLabelValues("empty").Inc()
 		reader = &bytes.Buffer{}
 		size = int64(0)
 	} else {
-		var err error
-		reader, err = source.GetReader(contentHash)
+		metrics.ContentLookups.WithLabelValues("source").Inc()
+		contentReader, err := source.GetReader(ctx, src, contentHash)
+		if source.IsPending(err) {
+			// not ready after all, so the backup must be retried later
+			return err
+		}
+		if source.IsCircuitOpen(err) {
+			// the source is down, so carrying on would only produce
+			// backups without their files
+			return err
+		}
 		if err != nil {
 			// Moodle handles restoring backups with missing files
 			// relatively gracefully, so warn but don't quit
-			logger.Err.WithError(err).Warnf("Unable to read file '%s', skipping", contentHash)
+			metrics.FilesMissing.Inc()
+			recordMissing(ctx, contentHash)
+			log.WithError(err).Warnf("Unable to read file '%s', skipping", contentHash)
+			return nil
+		}
+		defer contentReader.Close()
+		reader = contentReader
+		size = contentReader.Size()
+		if size < 0 {
+			// the tar header must be written before the file, so
+			// sources must report the size of files they return
+			metrics.FilesMissing.Inc()
+			recordMissing(ctx, contentHash)
+			log.Warnf("Unable to read file '%s' of unknown size from %s content source, skipping", contentHash, src.Name())
 			return nil
 		}
-		size = reader.(source.ContentReader).Size()
 	}
 
 	header := &tar.Header{
@@ -48,15 +125,22 @@ func injectFile(contentHash string, out *tar.Writer) error {
 	if _, err := io.Copy(out, reader); err != nil {
 		return fmt.Errorf("Failed writing file to output for %s: %v", contentHash, err)
 	}
+	metrics.FilesInjected.Inc()
+	log.WithFields(logrus.Fields{
+		"size":     size,
+		"duration": time.Since(start).Seconds(),
+	}).Debugf("Injected file '%s'", contentHash)
 
 	return nil
 }
 
 // ProcessFilesXML reads files.xml from in, adds all files it mentions to
-// out, then writes the original files.xml to out as well.
+// out from src, then writes the original files.xml to out as well.
+// Messages are logged to the entry carried by ctx, which should identify the
+// backup being processed.
 //
 // This is essentially the purpose of this software.
-func ProcessFilesXML(in io.Reader, out *tar.Writer) error {
+func ProcessFilesXML(ctx context.Context, in io.Reader, out *tar.Writer, src source.ContentSource) error {
 	doc := etree.NewDocument()
 	_, err := doc.ReadFrom(in)
 	if err != nil {
@@ -71,13 +155,48 @@ func ProcessFilesXML(in io.Reader, out *tar.Writer) error {
 	// need to keep track of files already injected so we can deduplicate
 	filesAdded := map[string]bool{}
 
-	for _, fileElement := range filesElement.ChildElements() {
+	// count unique files for progress reporting
+	fileElements := filesElement.ChildElements()
+	for _, fileElement := range fileElements {
+		if contentHashElement := fileElement.SelectElement("contenthash"); contentHashElement != nil {
+			filesAdded[contentHashElement.Text()] = false
+		}
+	}
+	progress.FromContext(ctx).SetFilesTotal(len(filesAdded))
+
+	// give the content source a chance to make the files ready, e.g. by
+	// restoring them from archival storage, before any are read
+	contentHashes := make([]string, 0, len(filesAdded))
+	for contentHash := range filesAdded {
+		if contentHash != emptyContentHash {
+			contentHashes = append(contentHashes, contentHash)
+		}
+	}
+	sort.Strings(contentHashes)
+	if err := source.Prepare(ctx, src, contentHashes); err != nil {
+		if source.IsPending(err) {
+			return err
+		}
+		logger.FromContext(ctx).WithError(err).Warnf("Unable to prepare files in %s content source", src.Name())
+	}
+
+	for _, fileElement := range fileElements {
 		contentHashElement := fileElement.SelectElement("contenthash")
+		if contentHashElement == nil {
+			// nothing to inject, and not counted in the total above
+			logger.FromContext(ctx).Warnf("Skipping file in files.xml without a contenthash")
+			continue
+		}
 		contentHash := contentHashElement.Text()
 
-		_, exists := filesAdded[contentHash]
-		if !exists {
-			if err := injectFile(contentHash, out); err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if filesAdded[contentHash] {
+			metrics.ContentLookups.WithLabelValues("duplicate").Inc()
+		} else {
+			if err := injectFile(ctx, src, contentHash, out); err != nil {
 				return err
 			}
 
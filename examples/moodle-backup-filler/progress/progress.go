@@ -0,0 +1,337 @@
+// Package progress tracks the progress of hydrating backups and reports it,
+// either as a continuously updated status line on an interactive terminal,
+// or as a periodic log message.
+package progress
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"moodle-backup-filler/logger"
+)
+
+// Progress reporting modes.
+const (
+	ModeAuto = "auto" // ModeTTY if stderr is a terminal, otherwise ModeLog
+	ModeTTY  = "tty"  // status line on stderr
+	ModeLog  = "log"  // periodic log message
+	ModeOff  = "off"  // no progress reporting
+)
+
+// backupProgress tracks the progress of a single backup.
+type backupProgress struct {
+	name       string
+	start      time.Time
+	entries    int64
+	filesDone  int64
+	filesTotal int64
+	bytes      int64
+}
+
+// batch tracks the progress of the run as a whole, and the backup currently
+// being hydrated.
+var batch struct {
+	sync.Mutex
+
+	start   time.Time
+	total   int
+	done    int
+	bytes   int64
+	current *backupProgress
+}
+
+func init() {
+	batch.start = time.Now()
+}
+
+// StartBatch records the number of backups to be hydrated by this run, if
+// known.
+func StartBatch(total int) {
+	batch.Lock()
+	defer batch.Unlock()
+
+	batch.start = time.Now()
+	batch.total = total
+}
+
+// SkipBackup records that one of the backups counted by StartBatch won't be
+// hydrated.
+func SkipBackup() {
+	batch.Lock()
+	defer batch.Unlock()
+
+	if batch.total > 0 {
+		batch.total--
+	}
+}
+
+// StartBackup records the start of hydration for the named backup.
+func StartBackup(name string) {
+	batch.Lock()
+	defer batch.Unlock()
+
+	batch.current = &backupProgress{
+		name:  name,
+		start: time.Now(),
+	}
+}
+
+// FinishBackup records the end of hydration for the current backup,
+// successful or otherwise.
+func FinishBackup() {
+	batch.Lock()
+	defer batch.Unlock()
+
+	batch.done++
+	batch.current = nil
+}
+
+// EntryCopied records an entry copied from the fileless backup.
+func EntryCopied() {
+	batch.Lock()
+	defer batch.Unlock()
+
+	if batch.current != nil {
+		batch.current.entries++
+	}
+}
+
+// SetFilesTotal records the number of files to be injected into the current
+// backup.
+func SetFilesTotal(total int) {
+	batch.Lock()
+	defer batch.Unlock()
+
+	if batch.current != nil {
+		batch.current.filesTotal = int64(total)
+	}
+}
+
+// FileInjected records a file injected into the current backup (or skipped
+// because it couldn't be read).
+func FileInjected() {
+	batch.Lock()
+	defer batch.Unlock()
+
+	if batch.current != nil {
+		batch.current.filesDone++
+	}
+}
+
+// AddBytes records bytes read from the content source.
+func AddBytes(n int64) {
+	batch.Lock()
+	defer batch.Unlock()
+
+	batch.bytes += n
+	if batch.current != nil {
+		batch.current.bytes += n
+	}
+}
+
+// status is a snapshot of progress used for reporting.
+type status struct {
+	backup     string
+	entries    int64
+	filesDone  int64
+	filesTotal int64
+	bytes      int64
+	throughput float64 // bytes per second
+	eta        time.Duration
+	batchDone  int
+	batchTotal int
+	batchBytes int64
+	batchETA   time.Duration
+}
+
+// eta estimates the time remaining given the time elapsed and the fraction
+// of work done, returning -1 if there's no basis for an estimate.
+func eta(elapsed time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 || fraction > 1 {
+		return -1
+	}
+
+	return time.Duration(float64(elapsed) * (1 - fraction) / fraction)
+}
+
+func snapshot() status {
+	batch.Lock()
+	defer batch.Unlock()
+
+	now := time.Now()
+	s := status{
+		batchDone:  batch.done,
+		batchTotal: batch.total,
+		batchBytes: batch.bytes,
+		eta:        -1,
+		batchETA:   -1,
+	}
+
+	// fraction of the current backup completed, based on files injected
+	var fraction float64
+	if c := batch.current; c != nil {
+		s.backup = c.name
+		s.entries = c.entries
+		s.filesDone = c.filesDone
+		s.filesTotal = c.filesTotal
+		s.bytes = c.bytes
+
+		elapsed := now.Sub(c.start)
+		if elapsed > 0 {
+			s.throughput = float64(c.bytes) / elapsed.Seconds()
+		}
+		if c.filesTotal > 0 {
+			fraction = float64(c.filesDone) / float64(c.filesTotal)
+			s.eta = eta(elapsed, fraction)
+		}
+	}
+
+	if batch.total > 0 {
+		s.batchETA = eta(now.Sub(batch.start), (float64(batch.done)+fraction)/float64(batch.total))
+	}
+
+	return s
+}
+
+// formatBytes renders n as a human readable size.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+// formatETA renders an estimate of time remaining.
+func formatETA(d time.Duration) string {
+	if d < 0 {
+		return "?"
+	}
+
+	return d.Round(time.Second).String()
+}
+
+// String renders the status as a single line.
+func (s status) String() string {
+	parts := []string{}
+
+	if s.backup != "" {
+		files := "?"
+		if s.filesTotal > 0 {
+			files = fmt.Sprintf("%d", s.filesTotal)
+		}
+		parts = append(parts, fmt.Sprintf("%s: %d entries, %d/%s files, %s at %s/s, ETA %s",
+			s.backup, s.entries, s.filesDone, files,
+			formatBytes(float64(s.bytes)), formatBytes(s.throughput), formatETA(s.eta)))
+	}
+
+	if s.batchTotal > 0 {
+		parts = append(parts, fmt.Sprintf("batch %d/%d, %s, ETA %s",
+			s.batchDone, s.batchTotal, formatBytes(float64(s.batchBytes)), formatETA(s.batchETA)))
+	} else {
+		parts = append(parts, fmt.Sprintf("%d backups, %s", s.batchDone, formatBytes(float64(s.batchBytes))))
+	}
+
+	return strings.Join(parts, " | ")
+}
+
+// Fields renders the status as log fields.
+func (s status) Fields() logrus.Fields {
+	fields := logrus.Fields{
+		"batch_done":  s.batchDone,
+		"batch_bytes": s.batchBytes,
+	}
+	if s.batchTotal > 0 {
+		fields["batch_total"] = s.batchTotal
+		fields["batch_eta"] = s.batchETA.Seconds()
+	}
+	if s.backup != "" {
+		fields["backup"] = s.backup
+		fields["entries"] = s.entries
+		fields["files_injected"] = s.filesDone
+		fields["files_total"] = s.filesTotal
+		fields["bytes"] = s.bytes
+		fields["throughput"] = s.throughput
+		if s.eta >= 0 {
+			fields["eta"] = s.eta.Seconds()
+		}
+	}
+
+	return fields
+}
+
+// clearLineHook clears the status line before each log message is written,
+// so log messages don't run on from the status line.
+type clearLineHook struct{}
+
+func (clearLineHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (clearLineHook) Fire(*logrus.Entry) error {
+	fmt.Fprint(os.Stderr, "\r\033[K")
+	return nil
+}
+
+// Start begins reporting progress in the given mode, every interval for
+// ModeLog or continuously for ModeTTY.  ModeAuto selects ModeTTY if log
+// messages are written to stderr and it's a terminal.  The returned function
+// stops reporting.
+func Start(mode string, interval time.Duration) (stop func()) {
+	if mode == ModeAuto {
+		if logger.Err.Out == os.Stderr && terminal.IsTerminal(int(os.Stderr.Fd())) {
+			mode = ModeTTY
+		} else {
+			mode = ModeLog
+		}
+	}
+
+	var report func()
+	switch mode {
+	case ModeTTY:
+		interval = 500 * time.Millisecond
+		logger.Err.Hooks.Add(clearLineHook{})
+		report = func() {
+			fmt.Fprintf(os.Stderr, "\r\033[K%s", snapshot())
+		}
+	case ModeLog:
+		report = func() {
+			s := snapshot()
+			logger.Err.WithFields(s.Fields()).Infof("Progress: %s", s)
+		}
+	default:
+		return func() {}
+	}
+
+	ticker := time.NewTicker(interval)
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		if mode == ModeTTY {
+			fmt.Fprint(os.Stderr, "\r\033[K")
+		}
+	}
+}
+
+// vim: nolist expandtab ts=4 sw=4
@@ -0,0 +1,64 @@
+package progress
+
+import (
+	"context"
+)
+
+// Tracker receives the progress of hydrating a backup.  Batch records it
+// for reporting by Start, and Discard ignores it.
+type Tracker interface {
+	// EntryCopied records an entry copied from the fileless backup.
+	EntryCopied()
+	// SetFilesTotal records the number of files to be injected.
+	SetFilesTotal(total int)
+	// FileInjected records a file injected (or skipped because it
+	// couldn't be read).
+	FileInjected()
+	// AddBytes records bytes read from the content source.
+	AddBytes(n int64)
+}
+
+// batchTracker is a Tracker which records progress in this package's batch
+// state.
+type batchTracker struct{}
+
+func (batchTracker) EntryCopied()            { EntryCopied() }
+func (batchTracker) SetFilesTotal(total int) { SetFilesTotal(total) }
+func (batchTracker) FileInjected()           { FileInjected() }
+func (batchTracker) AddBytes(n int64)        { AddBytes(n) }
+
+// discardTracker is a Tracker which ignores progress.
+type discardTracker struct{}
+
+func (discardTracker) EntryCopied()      {}
+func (discardTracker) SetFilesTotal(int) {}
+func (discardTracker) FileInjected()     {}
+func (discardTracker) AddBytes(n int64)  {}
+
+// Trackers for the command line tool's progress reporting, and for
+// libraries that don't report progress.
+var (
+	Batch   Tracker = batchTracker{}
+	Discard Tracker = discardTracker{}
+)
+
+// contextKey is the type of the key used to store a Tracker in a context.
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying t, to which progress made with
+// ctx is reported.
+func NewContext(ctx context.Context, t Tracker) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// FromContext returns the Tracker carried by ctx, or Discard if there isn't
+// one.
+func FromContext(ctx context.Context) Tracker {
+	if t, ok := ctx.Value(contextKey{}).(Tracker); ok {
+		return t
+	}
+
+	return Discard
+}
+
+// vim: nolist expandtab ts=4 sw=4
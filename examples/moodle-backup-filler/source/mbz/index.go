@@ -0,0 +1,260 @@
+package mbz
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"moodle-backup-filler/logger"
+	"moodle-backup-filler/moodle"
+)
+
+// indexVersion is incremented whenever the format of the saved index
+// changes, so older indexes are rebuilt.
+const indexVersion = 2
+
+// entry locates a file within a backup.
+type entry struct {
+	Archive string `json:"archive"`
+	Name    string `json:"name"`
+
+	// Position is the number of entries before this one in the backup.
+	Position int   `json:"position"`
+	Size     int64 `json:"size"`
+}
+
+// archiveInfo identifies the version of a backup that was indexed.
+type archiveInfo struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+}
+
+// index maps content hashes to the backups containing them.  Every copy of
+// a file is kept, so that it can still be found when one of the backups
+// containing it is changed or removed.
+type index struct {
+	mu sync.RWMutex
+
+	Version  int                     `json:"version"`
+	Archives map[string]*archiveInfo `json:"archives"`
+	Entries  map[string][]*entry     `json:"entries"`
+}
+
+func newIndex() *index {
+	return &index{
+		Version:  indexVersion,
+		Archives: map[string]*archiveInfo{},
+		Entries:  map[string][]*entry{},
+	}
+}
+
+// loadIndex reads a saved index, returning an empty index if there isn't
+// one yet.
+func loadIndex(filename string) (*index, error) {
+	idx := newIndex()
+
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// decode the version alone first, as older indexes don't match the
+	// current format
+	var version struct {
+		Version int `json:"version"`
+	}
+	if err := json.NewDecoder(file).Decode(&version); err != nil {
+		return nil, err
+	}
+	if version.Version != indexVersion {
+		return idx, nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := json.NewDecoder(file).Decode(idx); err != nil {
+		return nil, err
+	}
+
+	return idx, nil
+}
+
+// save writes the index to filename, replacing it atomically.
+func (idx *index) save(filename string) error {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	file, err := ioutil.TempFile(filepath.Dir(filename), ".mbz-index")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) // no-op once renamed
+
+	if err := json.NewEncoder(file).Encode(idx); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), filename)
+}
+
+// lookup returns the locations of the file with hash contentHash, in the
+// order the backups were given.
+func (idx *index) lookup(contentHash string) []*entry {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return append([]*entry(nil), idx.Entries[contentHash]...)
+}
+
+// update brings the index up to date with backups, indexing new and changed
+// backups and forgetting those no longer present.  It reports whether the
+// index changed.  Backups that can't be read are logged and skipped.
+func (idx *index) update(backups []string) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	present := map[string]bool{}
+	infos := map[string]*archiveInfo{}
+
+	// backups that have changed or gone are forgotten all at once, as
+	// that means looking through every file in the index
+	stale := map[string]bool{}
+
+	for _, backup := range backups {
+		present[backup] = true
+
+		fileInfo, err := os.Stat(backup)
+		if err != nil {
+			logger.Err.WithError(err).Warnf("Unable to read backup '%s', skipping", backup)
+			continue
+		}
+		info := &archiveInfo{
+			Size:    fileInfo.Size(),
+			ModTime: fileInfo.ModTime(),
+		}
+		old, ok := idx.Archives[backup]
+		if ok && old.Size == info.Size && old.ModTime.Equal(info.ModTime) {
+			continue
+		}
+		if ok {
+			stale[backup] = true
+		}
+		infos[backup] = info
+	}
+	for backup := range idx.Archives {
+		if !present[backup] {
+			stale[backup] = true
+		}
+	}
+	if len(stale) == 0 && len(infos) == 0 {
+		return false
+	}
+	idx.forget(stale)
+
+	for _, backup := range backups {
+		info, ok := infos[backup]
+		if !ok {
+			continue
+		}
+
+		start := time.Now()
+		entries, err := indexBackup(backup)
+		if err != nil {
+			logger.Err.WithError(err).Warnf("Unable to index backup '%s', skipping", backup)
+			continue
+		}
+		for contentHash, e := range entries {
+			idx.Entries[contentHash] = append(idx.Entries[contentHash], e)
+		}
+		idx.Archives[backup] = info
+		logger.Err.WithField("duration", time.Since(start).Seconds()).Infof("Indexed %d files in backup '%s'", len(entries), backup)
+	}
+
+	// keep the copies of each file in the order the backups were given
+	order := map[string]int{}
+	for i, backup := range backups {
+		order[backup] = i
+	}
+	for _, entries := range idx.Entries {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return order[entries[i].Archive] < order[entries[j].Archive]
+		})
+	}
+
+	return true
+}
+
+// forget removes backups and their copies of files from the index.
+func (idx *index) forget(backups map[string]bool) {
+	if len(backups) == 0 {
+		return
+	}
+
+	for backup := range backups {
+		delete(idx.Archives, backup)
+	}
+	for contentHash, entries := range idx.Entries {
+		kept := entries[:0]
+		for _, e := range entries {
+			if !backups[e.Archive] {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == 0 {
+			delete(idx.Entries, contentHash)
+		} else {
+			idx.Entries[contentHash] = kept
+		}
+	}
+}
+
+// indexBackup returns the files in the backup, keyed by content hash.
+func indexBackup(backup string) (map[string]*entry, error) {
+	file, err := os.Open(backup)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := moodle.NewBackupReader(file, file)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	entries := map[string]*entry{}
+	for position := 0; ; position++ {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading entry %d: %v", position, err)
+		}
+
+		if match := filePattern.FindStringSubmatch(header.Name); match != nil {
+			entries[match[1]] = &entry{
+				Archive:  backup,
+				Name:     header.Name,
+				Position: position,
+				Size:     header.Size,
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// vim: nolist expandtab ts=4 sw=4
@@ -0,0 +1,115 @@
+package mbz
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeBackup writes a .mbz containing a moodle_backup.xml and a file for
+// each of contentHashes, with the modification time modTime.
+func writeBackup(t *testing.T, filename string, modTime time.Time, contentHashes ...string) {
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+
+	names := []string{"moodle_backup.xml"}
+	for _, contentHash := range contentHashes {
+		names = append(names, "files/"+contentHash[:2]+"/"+contentHash)
+	}
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(name)), Mode: 0644, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// archives returns the backups idx has copies of contentHash in.
+func archives(idx *index, contentHash string) string {
+	names := []string{}
+	for _, e := range idx.lookup(contentHash) {
+		names = append(names, filepath.Base(e.Archive))
+	}
+
+	return strings.Join(names, ",")
+}
+
+func TestIndexUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hashA := strings.Repeat("a", 40)
+	hashB := strings.Repeat("b", 40)
+	hashC := strings.Repeat("c", 40)
+	one := filepath.Join(dir, "one.mbz")
+	two := filepath.Join(dir, "two.mbz")
+	modTime := time.Now().Add(-time.Hour)
+	writeBackup(t, one, modTime, hashA, hashB)
+	writeBackup(t, two, modTime, hashB)
+
+	idx := newIndex()
+	if !idx.update([]string{one, two}) {
+		t.Errorf("expected index to change")
+	}
+	if got := archives(idx, hashB); got != "one.mbz,two.mbz" {
+		t.Errorf("expected %s in one.mbz,two.mbz, got %s", hashB, got)
+	}
+	if idx.update([]string{one, two}) {
+		t.Errorf("expected unchanged backups to leave index unchanged")
+	}
+
+	// a changed backup's old files are forgotten
+	writeBackup(t, one, modTime.Add(time.Minute), hashC)
+	if !idx.update([]string{one, two}) {
+		t.Errorf("expected index to change")
+	}
+	if got := archives(idx, hashA); got != "" {
+		t.Errorf("expected %s to be forgotten, got %s", hashA, got)
+	}
+	if got := archives(idx, hashB); got != "two.mbz" {
+		t.Errorf("expected %s in two.mbz, got %s", hashB, got)
+	}
+	if got := archives(idx, hashC); got != "one.mbz" {
+		t.Errorf("expected %s in one.mbz, got %s", hashC, got)
+	}
+
+	// as are a removed backup's
+	if !idx.update([]string{one}) {
+		t.Errorf("expected index to change")
+	}
+	if got := archives(idx, hashB); got != "" {
+		t.Errorf("expected %s to be forgotten, got %s", hashB, got)
+	}
+	if len(idx.Archives) != 1 || idx.Archives[one] == nil {
+		t.Errorf("expected only one.mbz to be indexed, got %v", idx.Archives)
+	}
+}
+
+// vim: nolist expandtab ts=4 sw=4
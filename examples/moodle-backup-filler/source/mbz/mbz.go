@@ -0,0 +1,430 @@
+// Package mbz provides a content source that reads files from full Moodle
+// course backups, for hydrating fileless backups from older full backups
+// that already contain the files they reference.  Importing the package
+// registers the "mbz" scheme, e.g. mbz:///path/to/backups for all .mbz
+// files in a directory, or mbz:///path/a.mbz,/path/b.mbz for a list of
+// backups.
+//
+// An index of the files in each backup is built the first time it's used,
+// and saved so later runs only need to index new or changed backups.
+package mbz
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"moodle-backup-filler/logger"
+	"moodle-backup-filler/moodle"
+	"moodle-backup-filler/source"
+)
+
+// filePattern matches the names of files within a Moodle backup, capturing
+// the content hash.
+var filePattern = regexp.MustCompile(`^files/[0-9a-f]{2}/([0-9a-f]{40})$`)
+
+func init() {
+	source.Register("mbz", newSourceFromURL)
+}
+
+// Options configures a Source.
+type Options struct {
+	// Paths are full Moodle backups (tgz or zip format) or directories
+	// containing them, named *.mbz.
+	Paths []string
+
+	// IndexFile is where the index of files in the backups is saved.  It
+	// defaults to .mbz-index.json in the first directory, or the first
+	// backup's name with .index.json appended.
+	IndexFile string
+}
+
+// Source implements the source.ContentSource interface for files contained
+// in full Moodle backups.
+//
+// Files are read directly from zip formatted backups, but tgz formatted
+// backups can only be read sequentially, so reading a file means reading
+// the backup from the start (or from a file read earlier, if that's before
+// it in the backup).
+type Source struct {
+	opts  Options
+	index *index
+
+	// archives holds the open state of each backup, keyed by path
+	mu       sync.Mutex
+	archives map[string]*archive
+}
+
+// newSourceFromURL is the source.Factory for mbz:// content bases.  The
+// mbz_index_file option is optional.
+func newSourceFromURL(base string, opts source.Options) (source.ContentSource, error) {
+	paths := []string{}
+	for _, p := range strings.Split(strings.TrimPrefix(base, "mbz://"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+
+	return New(Options{
+		Paths:     paths,
+		IndexFile: opts["mbz_index_file"],
+	})
+}
+
+// New returns a ContentSource for the files in the backups described by
+// opts, indexing any backups that aren't already in the saved index.
+func New(opts Options) (*Source, error) {
+	if len(opts.Paths) == 0 {
+		return nil, fmt.Errorf("No Moodle backups provided for mbz content source")
+	}
+
+	backups, err := findBackups(opts.Paths)
+	if err != nil {
+		return nil, err
+	}
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("No .mbz files found in %s", strings.Join(opts.Paths, ", "))
+	}
+
+	if opts.IndexFile == "" {
+		if fileInfo, err := os.Stat(opts.Paths[0]); err == nil && fileInfo.IsDir() {
+			opts.IndexFile = filepath.Join(opts.Paths[0], ".mbz-index.json")
+		} else {
+			opts.IndexFile = opts.Paths[0] + ".index.json"
+		}
+	}
+
+	idx, err := loadIndex(opts.IndexFile)
+	if err != nil {
+		logger.Err.WithError(err).Warnf("Unable to load index '%s', rebuilding it", opts.IndexFile)
+		idx = newIndex()
+	}
+	if idx.update(backups) {
+		if err := idx.save(opts.IndexFile); err != nil {
+			logger.Err.WithError(err).Warnf("Unable to save index '%s', backups will be indexed again next time", opts.IndexFile)
+		}
+	}
+
+	return &Source{
+		opts:     opts,
+		index:    idx,
+		archives: map[string]*archive{},
+	}, nil
+}
+
+// findBackups returns the backups named by paths, expanding directories to
+// the .mbz files they contain.
+func findBackups(paths []string) ([]string, error) {
+	backups := []string{}
+	for _, p := range paths {
+		fileInfo, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !fileInfo.IsDir() {
+			backups = append(backups, p)
+			continue
+		}
+
+		matches, err := filepath.Glob(filepath.Join(p, "*.mbz"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		backups = append(backups, matches...)
+	}
+
+	return backups, nil
+}
+
+// Name returns "mbz".
+func (s *Source) Name() string {
+	return "mbz"
+}
+
+// Open returns a ContentReader for the file with hash contentHash, from the
+// first backup containing it that can be read.
+func (s *Source) Open(ctx context.Context, contentHash string) (source.ContentReader, error) {
+	entries := s.index.lookup(contentHash)
+	if len(entries) == 0 {
+		return nil, &source.NotFoundError{Message: fmt.Sprintf("File '%s' is not in any indexed backup", contentHash)}
+	}
+
+	var err error
+	for _, e := range entries {
+		var a *archive
+		a, err = s.archive(e.Archive)
+		if err != nil {
+			continue
+		}
+		var reader source.ContentReader
+		reader, err = a.open(ctx, e)
+		if err == nil {
+			return reader, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+
+	return nil, err
+}
+
+// Stat returns information about the file with hash contentHash, including
+// the first backup it's in.
+func (s *Source) Stat(ctx context.Context, contentHash string) (*source.FileInfo, error) {
+	entries := s.index.lookup(contentHash)
+	if len(entries) == 0 {
+		return nil, &source.NotFoundError{Message: fmt.Sprintf("File '%s' is not in any indexed backup", contentHash)}
+	}
+	e := entries[0]
+
+	return &source.FileInfo{
+		Size:     e.Size,
+		Location: e.Archive + "#" + e.Name,
+	}, nil
+}
+
+// Close closes any open backups.
+func (s *Source) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for path, a := range s.archives {
+		a.close()
+		delete(s.archives, path)
+	}
+
+	return nil
+}
+
+// archive returns the open state of the backup at path.
+func (s *Source) archive(path string) (*archive, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a, ok := s.archives[path]; ok {
+		return a, nil
+	}
+
+	a, err := openArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	s.archives[path] = a
+
+	return a, nil
+}
+
+// maxIdleReaders is the number of positioned readers kept for each tgz
+// backup, so that files requested in a few interleaved sequences don't each
+// mean reading the backup from the start.
+const maxIdleReaders = 4
+
+// archive is an open backup.  Zip backups are read through zipReader; tgz
+// backups through BackupReaders positioned part way through the backup.
+type archive struct {
+	path      string
+	zipReader *zip.ReadCloser
+	zipFiles  map[string]*zip.File
+
+	// mu guards idle, the tgz readers not currently in use, and closed
+	mu     sync.Mutex
+	idle   []*tgzReader
+	closed bool
+}
+
+// tgzReader is a BackupReader for a tgz backup, positioned after its first
+// position entries.
+type tgzReader struct {
+	reader   moodle.BackupReader
+	position int
+}
+
+func openArchive(path string) (*archive, error) {
+	a := &archive{path: path}
+
+	zipReader, err := zip.OpenReader(path)
+	if err == zip.ErrFormat {
+		// not a zip file, so assume tgz and open it when needed
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a.zipReader = zipReader
+	a.zipFiles = map[string]*zip.File{}
+	for _, file := range zipReader.File {
+		a.zipFiles[file.Name] = file
+	}
+
+	return a, nil
+}
+
+// open returns a ContentReader for the file described by e.
+//
+// A tgz backup can only be read sequentially, so the file is read with an
+// idle reader positioned before it if there is one, or otherwise by reading
+// the backup from the start.  The reader is used only by the returned
+// ContentReader, so any number of files can be open at once, and it's kept
+// for reading later files once closed.  Reading many files from a tgz
+// backup in an order other than the backup's own is slow, as each file
+// means reading the backup from the start.
+func (a *archive) open(ctx context.Context, e *entry) (source.ContentReader, error) {
+	if a.zipReader != nil {
+		file, ok := a.zipFiles[e.Name]
+		if !ok {
+			return nil, fmt.Errorf("'%s' is no longer in '%s'", e.Name, a.path)
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		return &contentReader{ReadCloser: reader, size: e.Size}, nil
+	}
+
+	r, err := a.seek(ctx, a.take(e), e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &contentReader{
+		ReadCloser: ioutil.NopCloser(io.LimitReader(r.reader, e.Size)),
+		size:       e.Size,
+		release:    func() { a.put(r) },
+	}, nil
+}
+
+// take removes and returns the idle tgz reader positioned closest before
+// e, or nil if there isn't one.
+func (a *archive) take(e *entry) *tgzReader {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	best := -1
+	for i, r := range a.idle {
+		if r.position <= e.Position && (best < 0 || r.position > a.idle[best].position) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+
+	r := a.idle[best]
+	a.idle = append(a.idle[:best], a.idle[best+1:]...)
+	return r
+}
+
+// put returns a tgz reader to the idle readers, replacing the one furthest
+// into the backup if there are already maxIdleReaders.
+func (a *archive) put(r *tgzReader) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		r.reader.Close()
+		return
+	}
+	if len(a.idle) >= maxIdleReaders {
+		furthest := 0
+		for i := range a.idle {
+			if a.idle[i].position > a.idle[furthest].position {
+				furthest = i
+			}
+		}
+		a.idle[furthest].reader.Close()
+		a.idle = append(a.idle[:furthest], a.idle[furthest+1:]...)
+	}
+	a.idle = append(a.idle, r)
+}
+
+// seek advances r to the entry e, opening the backup if r is nil, and
+// returns the reader positioned at e.
+func (a *archive) seek(ctx context.Context, r *tgzReader, e *entry) (*tgzReader, error) {
+	if r == nil {
+		file, err := os.Open(a.path)
+		if err != nil {
+			return nil, err
+		}
+		reader, err := moodle.NewBackupReader(file, file)
+		if err != nil {
+			return nil, err
+		}
+		r = &tgzReader{reader: reader}
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			a.put(r)
+			return nil, err
+		}
+
+		header, err := r.reader.Next()
+		if err != nil {
+			r.reader.Close()
+			return nil, fmt.Errorf("Unable to find '%s' in '%s': %v", e.Name, a.path, err)
+		}
+		r.position++
+
+		if r.position-1 == e.Position {
+			if header.Name != e.Name {
+				r.reader.Close()
+				return nil, fmt.Errorf("'%s' has changed since it was indexed", a.path)
+			}
+			return r, nil
+		}
+	}
+}
+
+func (a *archive) close() {
+	if a.zipReader != nil {
+		a.zipReader.Close()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, r := range a.idle {
+		r.reader.Close()
+	}
+	a.idle = nil
+	a.closed = true
+}
+
+// contentReader implements the source.ContentReader interface for a file
+// within a backup.
+type contentReader struct {
+	io.ReadCloser
+	size int64
+
+	// release is called once when the reader is closed
+	release func()
+}
+
+// Size returns the size of the file being read.
+func (cr *contentReader) Size() int64 {
+	return cr.size
+}
+
+// Close closes the file being read.
+func (cr *contentReader) Close() error {
+	err := cr.ReadCloser.Close()
+	if cr.release != nil {
+		cr.release()
+		cr.release = nil
+	}
+
+	return err
+}
+
+// vim: nolist expandtab ts=4 sw=4
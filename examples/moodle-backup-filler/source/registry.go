@@ -0,0 +1,84 @@
+package source
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Options holds settings for content sources beyond their base URL, keyed
+// by configuration option name, e.g. "s3_region".  Each backend reads the
+// options it understands and ignores the rest.
+type Options map[string]string
+
+// Factory constructs a ContentSource for base, a content base URL with the
+// scheme the factory was registered for.
+type Factory func(base string, opts Options) (ContentSource, error)
+
+// factories holds the registered backends, keyed by URL scheme.
+var factories = struct {
+	sync.RWMutex
+	m map[string]Factory
+}{m: map[string]Factory{}}
+
+// Register makes a content source backend available for content base URLs
+// with the given scheme, e.g. "s3" for s3://bucket/prefix.  Backends
+// usually register themselves from an init function, so importing their
+// package is enough to use them.  Register panics if scheme is already
+// registered.
+func Register(scheme string, factory Factory) {
+	factories.Lock()
+	defer factories.Unlock()
+
+	if factory == nil {
+		panic("source: Register factory is nil")
+	}
+	if _, dup := factories.m[scheme]; dup {
+		panic("source: Register called twice for scheme " + scheme)
+	}
+	factories.m[scheme] = factory
+}
+
+// Schemes returns the registered URL schemes in sorted order.
+func Schemes() []string {
+	factories.RLock()
+	defer factories.RUnlock()
+
+	schemes := make([]string, 0, len(factories.m))
+	for scheme := range factories.m {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+
+	return schemes
+}
+
+// scheme returns the URL scheme of base, or "file" if base is a local path.
+func scheme(base string) string {
+	if i := strings.Index(base, "://"); i > 0 {
+		return base[:i]
+	}
+
+	return "file"
+}
+
+// New returns a ContentSource for base using the backend registered for its
+// URL scheme.  base may also be a local path, which is handled by the
+// "file" backend.  The caller should Close the source once it's finished
+// with it.
+func New(base string, opts Options) (ContentSource, error) {
+	s := scheme(base)
+
+	factories.RLock()
+	factory, ok := factories.m[s]
+	factories.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unsupported content base '%s', scheme must be one of %s", base, strings.Join(Schemes(), ", "))
+	}
+
+	return factory(base, opts)
+}
+
+// vim: nolist expandtab ts=4 sw=4
@@ -0,0 +1,331 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"moodle-backup-filler/logger"
+	"moodle-backup-filler/metrics"
+)
+
+// ResilienceOptions configures a ResilientSource.
+type ResilienceOptions struct {
+	// Retries is how many times a failed Open or Stat is retried.
+	Retries int
+
+	// RetryBackoff is the delay before the first retry, which is doubled
+	// for each retry after that, with up to half as much again added at
+	// random so that concurrent requests don't retry in step.
+	RetryBackoff time.Duration
+
+	// MaxConsecutiveFailures is how many files in a row can fail (after
+	// retries) before the source is assumed to be down, and every request
+	// fails with a *CircuitOpenError.  If zero, the source is never
+	// assumed to be down.
+	MaxConsecutiveFailures int
+
+	// RequestsPerSecond and BytesPerSecond limit the rate at which files
+	// are requested from and read from the source.  If zero, they're
+	// unlimited.
+	RequestsPerSecond float64
+	BytesPerSecond    int64
+}
+
+// ResilientSource wraps any ContentSource with retries, a circuit breaker
+// and rate limits, so that a source that is struggling or down isn't made
+// worse, and doesn't result in a run full of incomplete backups.
+//
+// Files that aren't in the source (see IsNotFound), can't be read from it
+// (see IsUnavailable) or aren't ready yet (see IsPending) aren't failures,
+// so are neither retried nor counted towards MaxConsecutiveFailures.
+// Errors reading a file once it has been opened can't be retried, as part
+// of it has already been used, but are counted.
+type ResilientSource struct {
+	src  ContentSource
+	opts ResilienceOptions
+
+	breaker  *breaker
+	requests *limiter
+	bytes    *limiter
+}
+
+// NewResilientSource returns a ContentSource which reads from src with the
+// retries, circuit breaker and rate limits described by opts.
+func NewResilientSource(src ContentSource, opts ResilienceOptions) *ResilientSource {
+	if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = time.Second
+	}
+
+	return &ResilientSource{
+		src:      src,
+		opts:     opts,
+		breaker:  &breaker{max: opts.MaxConsecutiveFailures},
+		requests: newLimiter(opts.RequestsPerSecond),
+		bytes:    newLimiter(float64(opts.BytesPerSecond)),
+	}
+}
+
+// Name returns the name of the wrapped source.
+func (s *ResilientSource) Name() string {
+	return s.src.Name()
+}
+
+// Open returns a ContentReader for the file with hash contentHash, retrying
+// if the wrapped source fails.
+func (s *ResilientSource) Open(ctx context.Context, contentHash string) (ContentReader, error) {
+	var reader ContentReader
+	err := s.do(ctx, "open", true, func() error {
+		var err error
+		reader, err = s.src.Open(ctx, contentHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &resilientReader{
+		ContentReader: reader,
+		ctx:           ctx,
+		source:        s,
+	}, nil
+}
+
+// Stat returns information about the file with hash contentHash, retrying
+// if the wrapped source fails.
+func (s *ResilientSource) Stat(ctx context.Context, contentHash string) (*FileInfo, error) {
+	var info *FileInfo
+	err := s.do(ctx, "stat", false, func() error {
+		var err error
+		info, err = s.src.Stat(ctx, contentHash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// Validate validates the wrapped source, if it can be.
+func (s *ResilientSource) Validate(ctx context.Context) error {
+	if v, ok := s.src.(Validator); ok {
+		return v.Validate(ctx)
+	}
+
+	return nil
+}
+
+// Prepare prepares files in the wrapped source, if it needs that.
+func (s *ResilientSource) Prepare(ctx context.Context, contentHashes []string) error {
+	return Prepare(ctx, s.src, contentHashes)
+}
+
+// Close closes the wrapped source.
+func (s *ResilientSource) Close() error {
+	return s.src.Close()
+}
+
+// do calls op, waiting for the request rate limit first, and retrying with
+// backoff if it fails.  Once it has failed on every attempt, the failure is
+// counted by the circuit breaker.  If opened is true, op opens a file, and
+// it only counts as a success once the file has been read (see
+// resilientReader), so that a source which fails part way through every
+// file still opens the breaker.
+func (s *ResilientSource) do(ctx context.Context, action string, opened bool, op func() error) error {
+	log := logger.FromContext(ctx)
+	backoff := s.opts.RetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		if err := s.breaker.check(s.src.Name()); err != nil {
+			return err
+		}
+		if err := s.requests.wait(ctx, 1); err != nil {
+			return err
+		}
+
+		err := op()
+		if !isFailure(ctx, err) {
+			if ctx.Err() == nil && (err != nil || !opened) {
+				s.breaker.success()
+			}
+			return err
+		}
+		if attempt >= s.opts.Retries {
+			s.breaker.failure(err)
+			return err
+		}
+
+		delay := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+		backoff *= 2
+		metrics.SourceRetries.WithLabelValues(s.src.Name()).Inc()
+		log.WithError(err).Debugf("Unable to %s file in %s content source, retrying in %v (attempt %d of %d)", action, s.src.Name(), delay, attempt+2, s.opts.Retries+1)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// isFailure returns true if err means the source failed, rather than that
+// the file isn't available or the request was cancelled.
+func isFailure(ctx context.Context, err error) bool {
+	return err != nil && !IsNotFound(err) && !IsUnavailable(err) && !IsPending(err) && ctx.Err() == nil
+}
+
+// resilientReader wraps a ContentReader to limit the rate at which it's
+// read, and count errors reading it as failures of the source and reading
+// it to the end as a success.
+type resilientReader struct {
+	ContentReader
+	ctx    context.Context
+	source *ResilientSource
+}
+
+// Read reads bytes from the underlying ContentReader, then waits for the
+// bandwidth limit.
+func (r *resilientReader) Read(b []byte) (int, error) {
+	n, err := r.ContentReader.Read(b)
+	if err != nil && r.ctx.Err() == nil {
+		if err == io.EOF {
+			r.source.breaker.success()
+		} else {
+			r.source.breaker.failure(err)
+		}
+	}
+	if n > 0 {
+		if werr := r.source.bytes.wait(r.ctx, float64(n)); werr != nil && err == nil {
+			err = werr
+		}
+	}
+
+	return n, err
+}
+
+// CircuitOpenError is returned by a ResilientSource once too many files in
+// a row have failed, so that the run can be stopped rather than carry on
+// producing backups without their files.
+type CircuitOpenError struct {
+	// Source is the name of the source.
+	Source string
+
+	// Failures is the number of consecutive failures.
+	Failures int
+
+	// Err is the last failure.
+	Err error
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s content source failed for %d files in a row, assuming it's down: %v", e.Source, e.Failures, e.Err)
+}
+
+// IsCircuitOpen returns true if err is a *CircuitOpenError.
+func IsCircuitOpen(err error) bool {
+	_, ok := err.(*CircuitOpenError)
+	return ok
+}
+
+// breaker counts consecutive failures, opening once there are max of them.
+// Once open, it stays open for the rest of the run.
+type breaker struct {
+	mu       sync.Mutex
+	max      int
+	failures int
+	lastErr  error
+}
+
+// check returns a *CircuitOpenError if the breaker is open.
+func (b *breaker) check(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.max <= 0 || b.failures < b.max {
+		return nil
+	}
+
+	return &CircuitOpenError{
+		Source:   name,
+		Failures: b.failures,
+		Err:      b.lastErr,
+	}
+}
+
+// success resets the count of consecutive failures, unless the breaker is
+// already open.
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.max <= 0 || b.failures < b.max {
+		b.failures = 0
+	}
+}
+
+// failure counts a failure.
+func (b *breaker) failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.lastErr = err
+}
+
+// limiter spaces out uses of a resource so that on average no more than
+// rate are used per second.
+type limiter struct {
+	mu   sync.Mutex
+	rate float64
+	next time.Time
+}
+
+// newLimiter returns a limiter for rate uses per second, or nil (which
+// doesn't limit) if rate is zero.
+func newLimiter(rate float64) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &limiter{rate: rate}
+}
+
+// wait reserves n uses, waiting until the uses reserved before them are
+// due.
+func (l *limiter) wait(ctx context.Context, n float64) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	due := l.next
+	l.next = l.next.Add(time.Duration(n / l.rate * float64(time.Second)))
+	l.mu.Unlock()
+
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// vim: nolist expandtab ts=4 sw=4
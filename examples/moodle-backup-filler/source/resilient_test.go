@@ -0,0 +1,261 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingSource is a ContentSource which fails its first fails requests
+// with err, then serves data.
+type failingSource struct {
+	fails   int
+	err     error
+	data    string
+	readErr error
+	calls   int
+}
+
+func (s *failingSource) Name() string {
+	return "failing"
+}
+
+func (s *failingSource) Open(ctx context.Context, contentHash string) (ContentReader, error) {
+	s.calls++
+	if s.calls <= s.fails {
+		return nil, s.err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return &failingReader{Reader: strings.NewReader(s.data), size: int64(len(s.data)), err: s.readErr}, nil
+}
+
+func (s *failingSource) Stat(ctx context.Context, contentHash string) (*FileInfo, error) {
+	s.calls++
+	if s.calls <= s.fails {
+		return nil, s.err
+	}
+
+	return &FileInfo{Size: int64(len(s.data)), Location: contentHash}, nil
+}
+
+func (s *failingSource) Close() error {
+	return nil
+}
+
+// failingReader reads from Reader, then returns err (if set) instead of
+// io.EOF.
+type failingReader struct {
+	io.Reader
+	size int64
+	err  error
+}
+
+func (r *failingReader) Size() int64 {
+	return r.size
+}
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if err == io.EOF && r.err != nil {
+		err = r.err
+	}
+
+	return n, err
+}
+
+func (r *failingReader) Close() error {
+	return nil
+}
+
+func TestResilientRetries(t *testing.T) {
+	src := &failingSource{fails: 2, err: errors.New("connection reset"), data: "content"}
+	rs := NewResilientSource(src, ResilienceOptions{Retries: 2, RetryBackoff: time.Millisecond})
+
+	reader, err := rs.Open(context.Background(), "hash")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer reader.Close()
+	if src.calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", src.calls)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if string(data) != "content" {
+		t.Errorf("expected %q, got %q", "content", data)
+	}
+
+	src = &failingSource{fails: 3, err: errors.New("connection reset")}
+	rs = NewResilientSource(src, ResilienceOptions{Retries: 2, RetryBackoff: time.Millisecond})
+	if _, err := rs.Stat(context.Background(), "hash"); err == nil {
+		t.Errorf("expected error once retries are used up")
+	}
+	if src.calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", src.calls)
+	}
+}
+
+func TestResilientNotFailures(t *testing.T) {
+	tests := []error{
+		&NotFoundError{Message: "not found"},
+		&UnavailableError{Message: "archived"},
+		&PendingError{ContentHashes: []string{"hash"}, Reason: "restoring"},
+	}
+
+	for _, test := range tests {
+		src := &failingSource{fails: 1, err: test}
+		rs := NewResilientSource(src, ResilienceOptions{Retries: 2, RetryBackoff: time.Millisecond, MaxConsecutiveFailures: 1})
+
+		if _, err := rs.Open(context.Background(), "hash"); err != test {
+			t.Errorf("%T: expected the source's error, got %v", test, err)
+		}
+		if src.calls != 1 {
+			t.Errorf("%T: expected 1 attempt, got %d", test, src.calls)
+		}
+		if _, err := rs.Stat(context.Background(), "hash"); err != nil {
+			t.Errorf("%T: expected breaker to stay closed, got %v", test, err)
+		}
+	}
+}
+
+func TestResilientBreaker(t *testing.T) {
+	failure := errors.New("connection reset")
+	src := &failingSource{fails: 2, err: failure}
+	rs := NewResilientSource(src, ResilienceOptions{RetryBackoff: time.Millisecond, MaxConsecutiveFailures: 2})
+
+	// A success between failures resets the count.
+	if _, err := rs.Stat(context.Background(), "a"); err != failure {
+		t.Fatalf("expected failure, got %v", err)
+	}
+	src.fails, src.calls = 0, 0
+	if _, err := rs.Stat(context.Background(), "b"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	src.fails, src.calls = 1, 0
+	if _, err := rs.Stat(context.Background(), "c"); err != failure {
+		t.Fatalf("expected failure, got %v", err)
+	}
+	src.calls = 0
+	if _, err := rs.Stat(context.Background(), "d"); err != failure {
+		t.Fatalf("expected failure, got %v", err)
+	}
+
+	// Two failures in a row open it, and it stays open.
+	src.fails, src.calls = 0, 0
+	_, err := rs.Stat(context.Background(), "e")
+	if !IsCircuitOpen(err) {
+		t.Fatalf("expected *CircuitOpenError, got %v", err)
+	}
+	if e := err.(*CircuitOpenError); e.Failures != 2 || e.Err != failure {
+		t.Errorf("expected 2 failures ending in %v, got %d ending in %v", failure, e.Failures, e.Err)
+	}
+	if src.calls != 0 {
+		t.Errorf("expected no requests once open, got %d", src.calls)
+	}
+	rs.breaker.success()
+	if _, err := rs.Stat(context.Background(), "f"); !IsCircuitOpen(err) {
+		t.Errorf("expected breaker to stay open, got %v", err)
+	}
+}
+
+func TestResilientBreakerCancelled(t *testing.T) {
+	failure := errors.New("connection reset")
+	src := &failingSource{fails: 1, err: failure}
+	rs := NewResilientSource(src, ResilienceOptions{RetryBackoff: time.Millisecond, MaxConsecutiveFailures: 2})
+
+	if _, err := rs.Open(context.Background(), "a"); err != failure {
+		t.Fatalf("expected failure, got %v", err)
+	}
+
+	// A cancelled request is neither a failure nor a success.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := rs.Open(ctx, "b"); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if rs.breaker.failures != 1 {
+		t.Errorf("expected cancelled request to leave 1 failure, got %d", rs.breaker.failures)
+	}
+
+	src.fails, src.calls = 1, 0
+	if _, err := rs.Open(context.Background(), "c"); err != failure {
+		t.Fatalf("expected failure, got %v", err)
+	}
+	if _, err := rs.Open(context.Background(), "d"); !IsCircuitOpen(err) {
+		t.Errorf("expected *CircuitOpenError, got %v", err)
+	}
+}
+
+func TestResilientReaderFailures(t *testing.T) {
+	readErr := errors.New("unexpected EOF")
+	src := &failingSource{data: "content", readErr: readErr}
+	rs := NewResilientSource(src, ResilienceOptions{RetryBackoff: time.Millisecond, MaxConsecutiveFailures: 2})
+
+	// Reading to the end isn't a failure.
+	src.readErr = nil
+	reader, err := rs.Open(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if rs.breaker.failures != 0 {
+		t.Errorf("expected no failures, got %d", rs.breaker.failures)
+	}
+
+	// An error part way through is.
+	src.readErr = readErr
+	for i := 1; i <= 2; i++ {
+		reader, err := rs.Open(context.Background(), "b")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := ioutil.ReadAll(reader); err != readErr {
+			t.Fatalf("expected %v, got %v", readErr, err)
+		}
+		if rs.breaker.failures != i {
+			t.Errorf("expected %d failures, got %d", i, rs.breaker.failures)
+		}
+	}
+	if _, err := rs.Open(context.Background(), "c"); !IsCircuitOpen(err) {
+		t.Errorf("expected *CircuitOpenError, got %v", err)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	if err := newLimiter(0).wait(context.Background(), 1000); err != nil {
+		t.Errorf("unexpected error from unlimited limiter: %v", err)
+	}
+
+	l := newLimiter(100)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if err := l.wait(context.Background(), 1); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected 6 uses at 100/s to take at least 50ms, took %v", elapsed)
+	}
+
+	// A large reservation delays whoever comes next, unless cancelled.
+	l = newLimiter(10)
+	l.wait(context.Background(), 100)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx, 1); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+// vim: nolist expandtab ts=4 sw=4
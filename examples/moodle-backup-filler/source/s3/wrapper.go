@@ -9,8 +9,10 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
 
 	"moodle-backup-filler/logger"
+	"moodle-backup-filler/metrics"
 )
 
 // S3 provides TTFB/Retry functionality for S3 calls.
@@ -30,30 +32,35 @@ type ttfbTime struct {
 	time         time.Time
 	gotFirstByte bool
 	cancel       *context.CancelFunc
+	log          *logrus.Entry
 }
 
 func (t *ttfbTime) cancelConnection() {
 	if !t.gotFirstByte {
-		logger.Err.Debugf("S3 source: TTFB timelimit exceeded: %d", time.Since(t.time)/time.Millisecond)
+		t.log.Debugf("S3 source: TTFB timelimit exceeded: %d", time.Since(t.time)/time.Millisecond)
 		(*t.cancel)()
 	}
 }
 
-// getTTFBTimeoutContext provides a context with a TTFB timeout attached.
-func getTTFBTimeoutContext(ttfbTimeout int64) context.Context {
+// getTTFBTimeoutContext provides a child of parent with a TTFB timeout
+// attached.
+func getTTFBTimeoutContext(parent context.Context, ttfbTimeout int64, log *logrus.Entry) context.Context {
 	start := &ttfbTime{
 		time:         time.Now(),
 		gotFirstByte: false,
+		log:          log,
 	}
 
 	trace := &httptrace.ClientTrace{
 		GotFirstResponseByte: func() {
 			start.gotFirstByte = true
-			logger.Err.Debugf("S3 source: TTFB: %d", time.Since(start.time)/time.Millisecond)
+			ttfb := time.Since(start.time)
+			metrics.S3TTFB.Observe(ttfb.Seconds())
+			log.Debugf("S3 source: TTFB: %d", ttfb/time.Millisecond)
 		},
 	}
 
-	ctx, cancel := context.WithCancel(httptrace.WithClientTrace(context.Background(), trace))
+	ctx, cancel := context.WithCancel(httptrace.WithClientTrace(parent, trace))
 	start.cancel = &cancel
 
 	time.AfterFunc(time.Duration(ttfbTimeout)*time.Millisecond, start.cancelConnection)
@@ -61,23 +68,46 @@ func getTTFBTimeoutContext(ttfbTimeout int64) context.Context {
 	return ctx
 }
 
+// GetObjectWithTTFB makes a single GetObject request, recording its time to
+// first byte.  Messages are logged to the entry carried by parent.
+func (s3 *S3) GetObjectWithTTFB(parent context.Context, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	log := logger.FromContext(parent)
+	start := time.Now()
+	trace := &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			ttfb := time.Since(start)
+			metrics.S3TTFB.Observe(ttfb.Seconds())
+			log.Debugf("S3 source: TTFB: %d", ttfb/time.Millisecond)
+		},
+	}
+
+	return s3.GetObjectWithContext(httptrace.WithClientTrace(parent, trace), input)
+}
+
 // GetObjectWithRetry will cancel its request after the provided timeout and retry exactly once.
-func (s3 *S3) GetObjectWithRetry(input *s3.GetObjectInput, ttfbTimeout int64, ttfbRetries int64) (resp *s3.GetObjectOutput, err error) {
+// Messages are logged to the entry carried by parent, and cancelling parent
+// stops any further attempts.
+func (s3 *S3) GetObjectWithRetry(parent context.Context, input *s3.GetObjectInput, ttfbTimeout int64, ttfbRetries int64) (resp *s3.GetObjectOutput, err error) {
 	var attempt int64 = 1
 
+	log := logger.FromContext(parent)
 	delay := ttfbTimeout
 	for attempt <= ttfbRetries {
-		ctx := getTTFBTimeoutContext(delay)
+		ctx := getTTFBTimeoutContext(parent, delay, log)
 		resp, err = s3.GetObjectWithContext(ctx, input)
 
-		if ctx.Err() != context.Canceled {
+		if ctx.Err() != context.Canceled || parent.Err() != nil {
 			return resp, err
 		}
 
 		attempt++
 		delay *= 2
+		if attempt <= ttfbRetries {
+			metrics.S3Retries.Inc()
+		}
 	}
 
+	metrics.S3Timeouts.Inc()
 	err = errors.New("Request to S3 timed out")
 
 	return resp, err
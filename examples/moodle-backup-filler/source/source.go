@@ -1,10 +1,16 @@
 package source
 
 import (
+	"context"
+	"fmt"
 	"io"
-	"strings"
+	"os"
 
-	"moodle-backup-filler/config"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"moodle-backup-filler/logger"
+	"moodle-backup-filler/metrics"
+	"moodle-backup-filler/progress"
 )
 
 // ContentReader implements the io.Reader interface for a single file.
@@ -15,16 +21,188 @@ type ContentReader interface {
 	io.ReadCloser
 }
 
-// GetReader returns a ContentReader of the configured type for the file
-// with hash contentHash.
-func GetReader(contentHash string) (ContentReader, error) {
-	if strings.HasPrefix(config.Config.ContentBase, "s3://") {
-		return NewS3ContentReader(contentHash)
-	} else if strings.HasPrefix(config.Config.ContentBase, "http://") {
-		return NewHTTPContentReader(contentHash)
+// FileInfo describes a file found in a content source.
+type FileInfo struct {
+	// Size is the size of the file in bytes, or -1 if it isn't known.
+	Size int64
+
+	// Location identifies where the file was found, e.g. its path or URL.
+	Location string
+}
+
+// ContentSource provides access to the files in a Moodle file store, which
+// are identified by their content hash.  A ContentSource is created once
+// for a run, by New or a backend's constructor, and may be used by multiple
+// goroutines at once.
+type ContentSource interface {
+	// Name returns a short name for the type of source, e.g. "s3", for use
+	// in logs and metrics.
+	Name() string
+
+	// Open returns a ContentReader for the file with hash contentHash.
+	// Messages are logged to the entry carried by ctx (see
+	// logger.NewContext).
+	Open(ctx context.Context, contentHash string) (ContentReader, error)
+
+	// Stat returns information about the file with hash contentHash
+	// without reading it, or an error if it can't be found.
+	Stat(ctx context.Context, contentHash string) (*FileInfo, error)
+
+	// Close releases any resources held by the source, such as
+	// connections.  The source can't be used afterwards.
+	Close() error
+}
+
+// Validator is implemented by ContentSources that can check they're usable
+// before any files are read.
+type Validator interface {
+	// Validate returns an error describing why the source can't be used.
+	Validate(ctx context.Context) error
+}
+
+// NotFoundError is returned by a ContentSource when a file isn't in the
+// source, as distinct from the source failing.  Errors for which
+// os.IsNotExist is true are treated the same way.
+type NotFoundError struct {
+	Message string
+}
+
+func (e *NotFoundError) Error() string {
+	return e.Message
+}
+
+// IsNotFound returns true if err reports that a file isn't in a content
+// source.
+func IsNotFound(err error) bool {
+	if _, ok := err.(*NotFoundError); ok {
+		return true
+	}
+
+	return os.IsNotExist(err)
+}
+
+// UnavailableError is returned by a ContentSource when a file is in the
+// source but can't be read from it, such as an archived S3 object when
+// restores aren't configured.  Like a missing file, it's not a failure of
+// the source, and retrying won't help.
+type UnavailableError struct {
+	Message string
+}
+
+func (e *UnavailableError) Error() string {
+	return e.Message
+}
+
+// IsUnavailable returns true if err is an *UnavailableError.
+func IsUnavailable(err error) bool {
+	_, ok := err.(*UnavailableError)
+	return ok
+}
+
+// Preparer is implemented by ContentSources that need to do something
+// before some files can be read, such as restoring them from archival
+// storage.
+type Preparer interface {
+	// Prepare makes the files with hashes contentHashes ready to read,
+	// returning a *PendingError if some of them won't be ready until
+	// later.  Files that can't be found are left for Open to report.
+	Prepare(ctx context.Context, contentHashes []string) error
+}
+
+// PendingError reports files that exist in a content source but can't be
+// read yet, such as those being restored from archival storage.  A backup
+// needing them should be hydrated later, rather than without them.
+type PendingError struct {
+	// ContentHashes are the files that aren't ready.
+	ContentHashes []string
+
+	// Reason describes why they aren't ready.
+	Reason string
+}
+
+func (e *PendingError) Error() string {
+	if len(e.ContentHashes) == 1 {
+		return fmt.Sprintf("File '%s' is not available yet: %s", e.ContentHashes[0], e.Reason)
+	}
+
+	return fmt.Sprintf("%d files are not available yet: %s", len(e.ContentHashes), e.Reason)
+}
+
+// IsPending returns true if err is a *PendingError.
+func IsPending(err error) bool {
+	_, ok := err.(*PendingError)
+	return ok
+}
+
+// Prepare calls src's Prepare method if it implements Preparer, returning a
+// *PendingError if any of the files with hashes contentHashes can't be read
+// until later.
+func Prepare(ctx context.Context, src ContentSource, contentHashes []string) error {
+	if p, ok := src.(Preparer); ok {
+		return p.Prepare(ctx, contentHashes)
+	}
+
+	return nil
+}
+
+// countingReader wraps a ContentReader to count the bytes read from each
+// content source backend, for metrics and progress reporting.
+type countingReader struct {
+	ContentReader
+	bytes    prometheus.Counter
+	progress progress.Tracker
+}
+
+// Read reads bytes from the underlying ContentReader, counting them.
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.ContentReader.Read(b)
+	cr.bytes.Add(float64(n))
+	cr.progress.AddBytes(int64(n))
+
+	return n, err
+}
+
+// Validate confirms that src is usable, so that mistakes in the
+// configuration are reported once at startup rather than as a warning for
+// every file that can't be read.  If probeHash isn't empty, that file is
+// read from src as well.
+func Validate(ctx context.Context, src ContentSource, probeHash string) error {
+	if v, ok := src.(Validator); ok {
+		if err := v.Validate(ctx); err != nil {
+			return err
+		}
+	}
+
+	if probeHash != "" {
+		ctx = logger.NewContext(ctx, logger.FromContext(ctx).WithField("contenthash", probeHash))
+		reader, err := GetReader(ctx, src, probeHash)
+		if err != nil {
+			return fmt.Errorf("Unable to read content_probe_hash '%s' from %s content source: %v", probeHash, src.Name(), err)
+		}
+		reader.Close()
+	}
+
+	return nil
+}
+
+// GetReader returns a ContentReader from src for the file with hash
+// contentHash, recording metrics and progress for the request and the bytes
+// read.
+func GetReader(ctx context.Context, src ContentSource, contentHash string) (ContentReader, error) {
+	backend := src.Name()
+
+	reader, err := src.Open(ctx, contentHash)
+	if err != nil {
+		metrics.SourceRequests.WithLabelValues(backend, "error").Inc()
+		return nil, err
 	}
+	metrics.SourceRequests.WithLabelValues(backend, "ok").Inc()
 
-	return NewLocalContentReader(contentHash)
+	return &countingReader{
+		ContentReader: reader,
+		bytes:         metrics.SourceBytes.WithLabelValues(backend),
+		progress:      progress.FromContext(ctx),
+	}, nil
 }
 
 // vim: nolist expandtab ts=4 sw=4
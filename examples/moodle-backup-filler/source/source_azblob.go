@@ -0,0 +1,397 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// azureStorageResource is the resource managed identity tokens are
+// requested for.
+const azureStorageResource = "https://storage.azure.com/"
+
+// azureIMDSTokenURL is the Azure Instance Metadata Service endpoint from
+// which managed identity tokens are requested.  It's a variable so tests
+// can replace it.
+var azureIMDSTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// minTokenRefresh is the shortest time to wait before refreshing a managed
+// identity token, so that a token that's already expired (or a clock that's
+// wrong) doesn't have it refreshed continuously.
+const minTokenRefresh = 30 * time.Second
+
+// urlQueryPattern matches the query string of URLs in error messages, which
+// carries the SAS token if one is used.
+var urlQueryPattern = regexp.MustCompile(`(https?://[^\s?"']*)\?[^\s"']*`)
+
+func init() {
+	Register("azblob", newAzureBlobSourceFromURL)
+}
+
+// AzureBlobOptions configures an AzureBlobSource.  Credentials are chosen in
+// order of preference: SASToken, SharedKey, then the managed identity of the
+// Azure VM or container the filler is running in.
+type AzureBlobOptions struct {
+	// Account is the storage account name.
+	Account string
+
+	// Container is the name of the container from which to read files.
+	Container string
+
+	// Prefix is prepended to the name of each blob in the container.  If
+	// not empty, it should end with a slash.
+	Prefix string
+
+	// SASToken is a shared access signature granting read access to the
+	// container, with or without the leading "?".
+	SASToken string
+
+	// SharedKey is the storage account's shared key.
+	SharedKey string
+
+	// ClientID selects a user assigned managed identity.  If empty, the
+	// system assigned identity is used.
+	ClientID string
+
+	// Endpoint is the blob service URL, defaulting to
+	// https://<account>.blob.core.windows.net/.  Use
+	// http://127.0.0.1:10000/<account>/ for the Azurite emulator.
+	Endpoint string
+}
+
+// AzureBlobSource implements the ContentSource interface for files stored
+// in an Azure Blob Storage container using the standard Moodle layout.
+type AzureBlobSource struct {
+	opts      AzureBlobOptions
+	container azblob.ContainerURL
+	auth      string
+}
+
+// newAzureBlobSourceFromURL is the Factory for
+// azblob://account/container/prefix content bases.  The azure_sas_token,
+// azure_shared_key, azure_client_id and azure_endpoint options are
+// optional.
+func newAzureBlobSourceFromURL(base string, opts Options) (ContentSource, error) {
+	parts := strings.SplitN(strings.TrimPrefix(base, "azblob://"), "/", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("contentbase '%s' must be of the form azblob://account/container/prefix", base)
+	}
+
+	azOpts := AzureBlobOptions{
+		Account:   parts[0],
+		Container: parts[1],
+		SASToken:  opts["azure_sas_token"],
+		SharedKey: opts["azure_shared_key"],
+		ClientID:  opts["azure_client_id"],
+		Endpoint:  opts["azure_endpoint"],
+	}
+	if len(parts) > 2 {
+		if prefix := strings.Trim(parts[2], "/"); prefix != "" {
+			azOpts.Prefix = prefix + "/"
+		}
+	}
+
+	return NewAzureBlobSource(azOpts)
+}
+
+// NewAzureBlobSource returns a ContentSource for files in the container
+// described by opts.  Credentials are resolved immediately.
+func NewAzureBlobSource(opts AzureBlobOptions) (*AzureBlobSource, error) {
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net/", opts.Account)
+	}
+	if !strings.HasSuffix(endpoint, "/") {
+		endpoint = endpoint + "/"
+	}
+
+	containerURL, err := url.Parse(endpoint + opts.Container)
+	if err != nil {
+		return nil, fmt.Errorf("azure_endpoint '%s' is not a valid URL: %v", endpoint, err)
+	}
+
+	var credential azblob.Credential
+	var auth string
+	switch {
+	case opts.SASToken != "":
+		auth = "SAS token"
+		credential = azblob.NewAnonymousCredential()
+		containerURL.RawQuery = strings.TrimPrefix(opts.SASToken, "?")
+	case opts.SharedKey != "":
+		auth = "shared key"
+		credential, err = azblob.NewSharedKeyCredential(opts.Account, opts.SharedKey)
+		if err != nil {
+			return nil, fmt.Errorf("azure_shared_key is invalid: %v", err)
+		}
+	default:
+		auth = "managed identity"
+		credential, err = newManagedIdentityCredential(opts.ClientID)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get a managed identity token for Azure Storage, provide azure_sas_token or azure_shared_key if not running in Azure: %v", err)
+		}
+	}
+
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{
+		Retry: azblob.RetryOptions{
+			MaxTries:   4,
+			TryTimeout: 2 * time.Minute,
+		},
+	})
+
+	return &AzureBlobSource{
+		opts:      opts,
+		container: azblob.NewContainerURL(*containerURL, pipeline),
+		auth:      auth,
+	}, nil
+}
+
+// managedIdentityToken is the response to a token request to the Azure
+// Instance Metadata Service.
+type managedIdentityToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresOn   string `json:"expires_on"` // seconds since the epoch
+}
+
+// fetchManagedIdentityToken requests a token for Azure Storage for the
+// managed identity with clientID (or the system assigned identity if
+// empty), returning it and when it expires.
+func fetchManagedIdentityToken(clientID string) (string, time.Time, error) {
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", azureStorageResource)
+	if clientID != "" {
+		query.Set("client_id", clientID)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, azureIMDSTokenURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	request.Header.Set("Metadata", "true")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("Received status code '%d' from the instance metadata service", response.StatusCode)
+	}
+
+	token := &managedIdentityToken{}
+	if err := json.NewDecoder(response.Body).Decode(token); err != nil {
+		return "", time.Time{}, fmt.Errorf("Unable to parse token from the instance metadata service: %v", err)
+	}
+	expiresOn, err := strconv.ParseInt(token.ExpiresOn, 10, 64)
+	if err != nil || token.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("Invalid token from the instance metadata service")
+	}
+
+	return token.AccessToken, time.Unix(expiresOn, 0), nil
+}
+
+// tokenRefreshInterval returns how long to wait before refreshing a token
+// that expires at expires: five minutes before it expires, or halfway
+// there for tokens that don't last much longer than that, but never less
+// than minTokenRefresh, since azblob stops refreshing a token if it's
+// given a duration that isn't positive.
+func tokenRefreshInterval(expires time.Time) time.Duration {
+	lifetime := time.Until(expires)
+
+	interval := lifetime - 5*time.Minute
+	if interval < lifetime/2 {
+		interval = lifetime / 2
+	}
+	if interval < minTokenRefresh {
+		interval = minTokenRefresh
+	}
+
+	return interval
+}
+
+// newManagedIdentityCredential returns a credential using a token for the
+// managed identity with clientID (or the system assigned identity if
+// empty), which is refreshed before it expires.
+func newManagedIdentityCredential(clientID string) (azblob.Credential, error) {
+	token, expires, err := fetchManagedIdentityToken(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the refresher is called immediately, and then again each time the
+	// interval it returns has passed
+	first := true
+	return azblob.NewTokenCredential(token, func(tc azblob.TokenCredential) time.Duration {
+		if first {
+			first = false
+			return tokenRefreshInterval(expires)
+		}
+
+		token, expires, err := fetchManagedIdentityToken(clientID)
+		if err != nil {
+			// try again shortly; requests fail with the expired token
+			// in the meantime
+			return time.Minute
+		}
+		tc.SetToken(token)
+
+		return tokenRefreshInterval(expires)
+	}), nil
+}
+
+// Name returns "azblob".
+func (s *AzureBlobSource) Name() string {
+	return "azblob"
+}
+
+// blobURL returns the URL of the blob for the file with hash contentHash,
+// using the standard Moodle layout beneath the configured prefix.
+func (s *AzureBlobSource) blobURL(contentHash string) azblob.BlobURL {
+	paddedHash := contentHash + "____" // ensure slices below don't fail if contentHash is invalid
+
+	return s.container.NewBlobURL(fmt.Sprintf("%s%s/%s/%s", s.opts.Prefix, paddedHash[:2], paddedHash[2:4], contentHash))
+}
+
+// azureError summarises errors from the Azure SDK, whose messages include
+// the full request (and so any SAS token) and response.  The query strings
+// of URLs in other errors, such as those from the transport, are removed.
+func azureError(err error, blob azblob.BlobURL) error {
+	if storageErr, ok := err.(azblob.StorageError); ok && storageErr.Response() != nil {
+		location := blob.URL()
+		message := fmt.Sprintf("Received status code '%d' (%s) while reading '%s'", storageErr.Response().StatusCode, storageErr.ServiceCode(), location.Path)
+		if storageErr.Response().StatusCode == http.StatusNotFound {
+			return &NotFoundError{Message: message}
+		}
+		return fmt.Errorf("%s", message)
+	}
+
+	return stripURLQueries(err)
+}
+
+// stripURLQueries returns err with the query strings of any URLs in its
+// message removed, so that SAS tokens aren't logged.  Errors without URLs,
+// such as context cancellation, are returned unchanged.
+func stripURLQueries(err error) error {
+	if err == nil {
+		return nil
+	}
+	message := err.Error()
+	stripped := urlQueryPattern.ReplaceAllString(message, "$1")
+	if stripped == message {
+		return err
+	}
+
+	return fmt.Errorf("%s", stripped)
+}
+
+// Open returns a ContentReader for the file with hash contentHash.
+func (s *AzureBlobSource) Open(ctx context.Context, contentHash string) (ContentReader, error) {
+	blob := s.blobURL(contentHash)
+
+	reader, err := NewAzureBlobContentReader(ctx, blob)
+	if err != nil {
+		return nil, azureError(err, blob)
+	}
+
+	return reader, nil
+}
+
+// Stat returns information about the file with hash contentHash.
+func (s *AzureBlobSource) Stat(ctx context.Context, contentHash string) (*FileInfo, error) {
+	blob := s.blobURL(contentHash)
+
+	props, err := blob.GetProperties(ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		return nil, azureError(err, blob)
+	}
+
+	location := blob.URL()
+	location.RawQuery = "" // don't leak the SAS token
+
+	return &FileInfo{
+		Size:     props.ContentLength(),
+		Location: location.String(),
+	}, nil
+}
+
+// Close does nothing; the pipeline holds no resources that need releasing.
+func (s *AzureBlobSource) Close() error {
+	return nil
+}
+
+// Validate confirms that the container exists and is accessible with the
+// configured credentials.
+func (s *AzureBlobSource) Validate(ctx context.Context) error {
+	_, err := s.container.GetProperties(ctx, azblob.LeaseAccessConditions{})
+	if storageErr, ok := err.(azblob.StorageError); ok && storageErr.Response() != nil {
+		switch storageErr.Response().StatusCode {
+		case http.StatusForbidden:
+			return fmt.Errorf("Access denied to Azure container '%s' in account '%s' using %s, check its permissions", s.opts.Container, s.opts.Account, s.auth)
+		case http.StatusNotFound:
+			return fmt.Errorf("Azure container '%s' does not exist in account '%s', check contentbase", s.opts.Container, s.opts.Account)
+		}
+	}
+	if err != nil {
+		if storageErr, ok := err.(azblob.StorageError); ok && storageErr.Response() != nil {
+			err = fmt.Errorf("status code '%d' (%s)", storageErr.Response().StatusCode, storageErr.ServiceCode())
+		}
+		return fmt.Errorf("Unable to reach Azure container '%s' in account '%s': %v", s.opts.Container, s.opts.Account, stripURLQueries(err))
+	}
+
+	return nil
+}
+
+// AzureBlobContentReader implements the ContentReader interface for files
+// contained in an Azure Blob Storage container.
+type AzureBlobContentReader struct {
+	reader io.ReadCloser
+	size   int64
+}
+
+// NewAzureBlobContentReader returns a ContentReader which reads blob.
+// Interrupted downloads are resumed where they left off.
+func NewAzureBlobContentReader(ctx context.Context, blob azblob.BlobURL) (*AzureBlobContentReader, error) {
+	response, err := blob.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AzureBlobContentReader{
+		reader: response.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3}),
+		size:   response.ContentLength(),
+	}, nil
+}
+
+// Size returns the size of the currently open file.
+func (cr *AzureBlobContentReader) Size() int64 {
+	return cr.size
+}
+
+// Read reads bytes from the currently open file.  Errors from resumed
+// downloads have URLs' query strings removed, as for azureError.
+func (cr *AzureBlobContentReader) Read(b []byte) (int, error) {
+	n, err := cr.reader.Read(b)
+	if err != nil && err != io.EOF {
+		err = stripURLQueries(err)
+	}
+
+	return n, err
+}
+
+// Close closes the currently open file.
+func (cr *AzureBlobContentReader) Close() error {
+	return cr.reader.Close()
+}
+
+// vim: nolist expandtab ts=4 sw=4
@@ -0,0 +1,170 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// azuriteKey is the well known shared key of the Azurite emulator's
+// devstoreaccount1 account.
+const azuriteKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+func TestAzureErrorStripsSASToken(t *testing.T) {
+	blob := azblob.NewBlobURL(url.URL{Scheme: "https", Host: "account.blob.core.windows.net", Path: "/container/ab/cd/abcd"}, azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{}))
+	sasURL := "https://account.blob.core.windows.net/container/ab/cd/abcd?sv=2018-03-28&sig=c2VjcmV0"
+
+	tests := []error{
+		&url.Error{Op: "Get", URL: sasURL, Err: fmt.Errorf("dial tcp: i/o timeout")},
+		fmt.Errorf("-> github.com/Azure/azure-pipeline-go/pipeline.NewError, %s: connection reset", sasURL),
+	}
+	for _, test := range tests {
+		err := azureError(test, blob)
+		if strings.Contains(err.Error(), "sig=") || strings.Contains(err.Error(), "sv=") {
+			t.Errorf("SAS token not removed from '%s'", err)
+		}
+		if !strings.Contains(err.Error(), "https://account.blob.core.windows.net/container/ab/cd/abcd") {
+			t.Errorf("URL removed from '%s'", err)
+		}
+	}
+
+	if err := azureError(context.Canceled, blob); err != context.Canceled {
+		t.Errorf("context.Canceled changed to '%v'", err)
+	}
+}
+
+func TestTokenRefreshInterval(t *testing.T) {
+	tests := []struct {
+		lifetime time.Duration
+		min, max time.Duration
+	}{
+		{time.Hour, 54 * time.Minute, 55 * time.Minute},
+		{6 * time.Minute, 2*time.Minute + 50*time.Second, 3 * time.Minute},
+		{time.Minute, minTokenRefresh, minTokenRefresh},
+		{-time.Minute, minTokenRefresh, minTokenRefresh},
+	}
+
+	for _, test := range tests {
+		interval := tokenRefreshInterval(time.Now().Add(test.lifetime))
+		if interval < test.min || interval > test.max {
+			t.Errorf("Refresh interval for a token lasting %s is %s, expected %s to %s", test.lifetime, interval, test.min, test.max)
+		}
+	}
+}
+
+func TestFetchManagedIdentityToken(t *testing.T) {
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("resource") != azureStorageResource || r.URL.Query().Get("client_id") != "client" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": "token", "expires_on": "%d"}`, expires.Unix())
+	}))
+	defer server.Close()
+
+	saved := azureIMDSTokenURL
+	azureIMDSTokenURL = server.URL
+	defer func() { azureIMDSTokenURL = saved }()
+
+	token, tokenExpires, err := fetchManagedIdentityToken("client")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if token != "token" || !tokenExpires.Equal(expires) {
+		t.Errorf("Token is '%s' expiring %s, expected 'token' expiring %s", token, tokenExpires, expires)
+	}
+
+	if _, _, err := fetchManagedIdentityToken("other"); err == nil {
+		t.Errorf("Expected an error for an unknown identity")
+	}
+}
+
+// TestAzureBlobSourceAzurite reads files from the Azurite emulator, whose
+// blob service URL (e.g. http://127.0.0.1:10000/devstoreaccount1) is given
+// by AZURITE_BLOB_ENDPOINT.
+func TestAzureBlobSourceAzurite(t *testing.T) {
+	endpoint := os.Getenv("AZURITE_BLOB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("AZURITE_BLOB_ENDPOINT not set")
+	}
+
+	ctx := context.Background()
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	content := []byte("file content")
+	containerName := fmt.Sprintf("mbf-test-%d", time.Now().UnixNano())
+
+	credential, err := azblob.NewSharedKeyCredential("devstoreaccount1", azuriteKey)
+	if err != nil {
+		t.Fatalf("Unable to create credential: %v", err)
+	}
+	containerURL, _ := url.Parse(strings.TrimSuffix(endpoint, "/") + "/" + containerName)
+	container := azblob.NewContainerURL(*containerURL, azblob.NewPipeline(credential, azblob.PipelineOptions{}))
+	if _, err := container.Create(ctx, azblob.Metadata{}, azblob.PublicAccessNone); err != nil {
+		t.Fatalf("Unable to create container: %v", err)
+	}
+	defer container.Delete(ctx, azblob.ContainerAccessConditions{})
+	blob := container.NewBlockBlobURL("prefix/01/23/" + hash)
+	if _, err := blob.Upload(ctx, bytes.NewReader(content), azblob.BlobHTTPHeaders{}, azblob.Metadata{}, azblob.BlobAccessConditions{}); err != nil {
+		t.Fatalf("Unable to upload blob: %v", err)
+	}
+
+	src, err := newAzureBlobSourceFromURL("azblob://devstoreaccount1/"+containerName+"/prefix", Options{
+		"azure_shared_key": azuriteKey,
+		"azure_endpoint":   endpoint,
+	})
+	if err != nil {
+		t.Fatalf("Unable to create source: %v", err)
+	}
+	defer src.Close()
+
+	if err := src.(Validator).Validate(ctx); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+
+	reader, err := src.Open(ctx, hash)
+	if err != nil {
+		t.Fatalf("Unable to open file: %v", err)
+	}
+	got, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(got, content) || reader.Size() != int64(len(content)) {
+		t.Errorf("Read '%s' of size %d (%v), expected '%s'", got, reader.Size(), err, content)
+	}
+
+	info, err := src.Stat(ctx, hash)
+	if err != nil || info.Size != int64(len(content)) {
+		t.Errorf("Stat returned %+v (%v), expected size %d", info, err, len(content))
+	}
+
+	if _, err := src.Open(ctx, strings.Repeat("f", 40)); !IsNotFound(err) {
+		t.Errorf("Expected a NotFoundError for a missing file, got %v", err)
+	}
+
+	missing, err := newAzureBlobSourceFromURL("azblob://devstoreaccount1/"+containerName+"-missing", Options{
+		"azure_shared_key": azuriteKey,
+		"azure_endpoint":   endpoint,
+	})
+	if err != nil {
+		t.Fatalf("Unable to create source: %v", err)
+	}
+	if err := missing.(Validator).Validate(ctx); err == nil {
+		t.Errorf("Expected Validate to fail for a missing container")
+	}
+}
+
+// vim: nolist expandtab ts=4 sw=4
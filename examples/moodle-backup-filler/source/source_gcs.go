@@ -0,0 +1,258 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+func init() {
+	Register("gs", newGCSSourceFromURL)
+}
+
+// GCSOptions configures a GCSSource.
+type GCSOptions struct {
+	// Bucket is the name of the bucket from which to read files.
+	Bucket string
+
+	// Prefix is prepended to the name of each object in the bucket.  If
+	// not empty, it should end with a slash.
+	Prefix string
+
+	// CredentialsFile is the path of a service account JSON key file.  If
+	// empty, application default credentials are used.
+	CredentialsFile string
+
+	// Objects stored with a Content-Encoding (e.g. gzip) are decompressed
+	// when read, so have to be read in full before their size is known.  Up
+	// to SpoolMemoryLimit bytes (default 8MiB) are held in memory, and
+	// larger objects are spooled to a temporary file in SpoolDir (default
+	// the system temporary directory), up to SpoolMaxSize bytes (0 for no
+	// limit).
+	SpoolMemoryLimit int64
+	SpoolMaxSize     int64
+	SpoolDir         string
+}
+
+// GCSSource implements the ContentSource interface for files stored in a
+// Google Cloud Storage bucket using the standard Moodle layout.
+//
+// The client honours the STORAGE_EMULATOR_HOST environment variable, so it
+// can be pointed at an emulator such as fake-gcs-server.
+type GCSSource struct {
+	opts   GCSOptions
+	client *storage.Client
+	bucket *storage.BucketHandle
+}
+
+// newGCSSourceFromURL is the Factory for gs://bucket/prefix content bases.
+// The gcs_credentials_file, gcs_spool_memory, gcs_spool_max_size and
+// gcs_spool_dir options are optional.
+func newGCSSourceFromURL(base string, opts Options) (ContentSource, error) {
+	gcsOpts, err := parseGCSBase(base)
+	if err != nil {
+		return nil, err
+	}
+	gcsOpts.CredentialsFile = opts["gcs_credentials_file"]
+	gcsOpts.SpoolDir = opts["gcs_spool_dir"]
+	for key, value := range map[string]*int64{
+		"gcs_spool_memory":   &gcsOpts.SpoolMemoryLimit,
+		"gcs_spool_max_size": &gcsOpts.SpoolMaxSize,
+	} {
+		if opt := opts[key]; opt != "" {
+			*value, err = strconv.ParseInt(opt, 10, 64)
+			if err != nil || *value < 0 {
+				return nil, fmt.Errorf("%s '%s' must be a number of bytes", key, opt)
+			}
+		}
+	}
+
+	return NewGCSSource(gcsOpts)
+}
+
+// parseGCSBase returns GCSOptions with the bucket and prefix of the
+// gs://bucket/prefix content base.
+func parseGCSBase(base string) (GCSOptions, error) {
+	parts := strings.SplitN(strings.TrimPrefix(base, "gs://"), "/", 2)
+	if parts[0] == "" {
+		return GCSOptions{}, fmt.Errorf("contentbase '%s' does not include a bucket name", base)
+	}
+
+	opts := GCSOptions{Bucket: parts[0]}
+	if len(parts) > 1 {
+		if prefix := strings.Trim(parts[1], "/"); prefix != "" {
+			opts.Prefix = prefix + "/"
+		}
+	}
+
+	return opts, nil
+}
+
+// NewGCSSource returns a ContentSource for files in the bucket described by
+// opts.  Credentials are resolved immediately.
+func NewGCSSource(opts GCSOptions) (*GCSSource, error) {
+	if opts.SpoolMemoryLimit <= 0 {
+		opts.SpoolMemoryLimit = 8 << 20
+	}
+
+	clientOpts := []option.ClientOption{}
+	if opts.CredentialsFile != "" {
+		clientOpts = append(clientOpts, option.WithCredentialsFile(opts.CredentialsFile))
+	}
+
+	client, err := storage.NewClient(context.Background(), clientOpts...)
+	if err != nil {
+		if opts.CredentialsFile != "" {
+			return nil, fmt.Errorf("Unable to use gcs_credentials_file '%s': %v", opts.CredentialsFile, err)
+		}
+		return nil, fmt.Errorf("Unable to find Google Cloud application default credentials, provide gcs_credentials_file if not running in Google Cloud: %v", err)
+	}
+
+	return &GCSSource{
+		opts:   opts,
+		client: client,
+		bucket: client.Bucket(opts.Bucket),
+	}, nil
+}
+
+// Name returns "gs".
+func (s *GCSSource) Name() string {
+	return "gs"
+}
+
+// objectName returns the name of the object for the file with hash
+// contentHash, using the standard Moodle layout beneath the configured
+// prefix.
+func (s *GCSSource) objectName(contentHash string) string {
+	paddedHash := contentHash + "____" // ensure slices below don't fail if contentHash is invalid
+
+	return fmt.Sprintf("%s%s/%s/%s", s.opts.Prefix, paddedHash[:2], paddedHash[2:4], contentHash)
+}
+
+// Open returns a ContentReader for the file with hash contentHash.  Objects
+// which are decompressed as they're read are spooled, so that their size is
+// known before they're read.
+func (s *GCSSource) Open(ctx context.Context, contentHash string) (ContentReader, error) {
+	name := s.objectName(contentHash)
+
+	reader, err := NewGCSContentReader(ctx, s.bucket.Object(name))
+	if err == storage.ErrObjectNotExist {
+		return nil, &NotFoundError{Message: fmt.Sprintf("Object '%s' not found", name)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if reader.Size() >= 0 {
+		return reader, nil
+	}
+
+	defer reader.Close()
+	copied, size, err := spool(reader, s.opts.SpoolMemoryLimit, s.opts.SpoolMaxSize, s.opts.SpoolDir, "gcs_spool_max_size")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read object '%s': %v", name, err)
+	}
+
+	return &GCSContentReader{
+		reader: copied,
+		size:   size,
+	}, nil
+}
+
+// Stat returns information about the file with hash contentHash.
+func (s *GCSSource) Stat(ctx context.Context, contentHash string) (*FileInfo, error) {
+	name := s.objectName(contentHash)
+
+	attrs, err := s.bucket.Object(name).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, &NotFoundError{Message: fmt.Sprintf("Object '%s' not found", name)}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	size := attrs.Size
+	if attrs.ContentEncoding != "" {
+		// the size of the encoded object, not the file itself
+		size = -1
+	}
+
+	return &FileInfo{
+		Size:     size,
+		Location: fmt.Sprintf("gs://%s/%s", s.opts.Bucket, name),
+	}, nil
+}
+
+// Close closes the client's connections.
+func (s *GCSSource) Close() error {
+	return s.client.Close()
+}
+
+// Validate confirms that the bucket exists and is accessible with the
+// configured credentials.
+func (s *GCSSource) Validate(ctx context.Context) error {
+	_, err := s.bucket.Attrs(ctx)
+	if err == storage.ErrBucketNotExist {
+		return fmt.Errorf("GCS bucket '%s' does not exist, check contentbase", s.opts.Bucket)
+	}
+	if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusForbidden {
+		return fmt.Errorf("Access denied to GCS bucket '%s', check the permissions of your credentials", s.opts.Bucket)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to reach GCS bucket '%s': %v", s.opts.Bucket, err)
+	}
+
+	return nil
+}
+
+// GCSContentReader implements the ContentReader interface for files
+// contained in a Google Cloud Storage bucket.
+type GCSContentReader struct {
+	reader io.ReadCloser
+	size   int64
+}
+
+// NewGCSContentReader returns a ContentReader which reads object.  Objects
+// stored with a Content-Encoding are decompressed as they're read, so their
+// size is unknown (-1).
+func NewGCSContentReader(ctx context.Context, object *storage.ObjectHandle) (*GCSContentReader, error) {
+	reader, err := object.ReadCompressed(false).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	size := reader.Attrs.Size
+	if reader.Attrs.ContentEncoding != "" {
+		// the size of the encoded object, not the file itself
+		size = -1
+	}
+
+	return &GCSContentReader{
+		reader: reader,
+		size:   size,
+	}, nil
+}
+
+// Size returns the size of the currently open file, or -1 if it isn't
+// known.
+func (cr *GCSContentReader) Size() int64 {
+	return cr.size
+}
+
+// Read reads bytes from the currently open file.
+func (cr *GCSContentReader) Read(b []byte) (int, error) {
+	return cr.reader.Read(b)
+}
+
+// Close closes the currently open file.
+func (cr *GCSContentReader) Close() error {
+	return cr.reader.Close()
+}
+
+// vim: nolist expandtab ts=4 sw=4
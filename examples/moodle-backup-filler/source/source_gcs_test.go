@@ -0,0 +1,143 @@
+package source
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+func TestGCSObjectName(t *testing.T) {
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	tests := []struct {
+		base   string
+		bucket string
+		name   string
+	}{
+		{"gs://bucket", "bucket", "01/23/" + hash},
+		{"gs://bucket/", "bucket", "01/23/" + hash},
+		{"gs://bucket/prefix", "bucket", "prefix/01/23/" + hash},
+		{"gs://bucket/moodle/filedir/", "bucket", "moodle/filedir/01/23/" + hash},
+	}
+
+	for _, test := range tests {
+		opts, err := parseGCSBase(test.base)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.base, err)
+			continue
+		}
+		src := &GCSSource{opts: opts}
+		if src.opts.Bucket != test.bucket {
+			t.Errorf("%s: bucket is '%s', expected '%s'", test.base, src.opts.Bucket, test.bucket)
+		}
+		if name := src.objectName(hash); name != test.name {
+			t.Errorf("%s: object is '%s', expected '%s'", test.base, name, test.name)
+		}
+	}
+
+	if _, err := parseGCSBase("gs:///prefix"); err == nil {
+		t.Errorf("Expected an error for a content base without a bucket")
+	}
+}
+
+// TestGCSSourceEmulator reads files from fake-gcs-server, whose address
+// (e.g. localhost:4443) is given by STORAGE_EMULATOR_HOST.  The server must
+// be started with a matching -public-host for objects to be downloaded, e.g.
+// "fake-gcs-server -scheme http -port 4443 -public-host localhost:4443".
+func TestGCSSourceEmulator(t *testing.T) {
+	if os.Getenv("STORAGE_EMULATOR_HOST") == "" {
+		t.Skip("STORAGE_EMULATOR_HOST not set")
+	}
+
+	ctx := context.Background()
+	bucketName := fmt.Sprintf("mbf-test-%d", time.Now().UnixNano())
+	client, err := storage.NewClient(ctx, option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("Unable to create client: %v", err)
+	}
+	defer client.Close()
+	bucket := client.Bucket(bucketName)
+	if err := bucket.Create(ctx, "test", nil); err != nil {
+		t.Fatalf("Unable to create bucket: %v", err)
+	}
+
+	content := []byte("file content")
+	gzipped := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzipped)
+	gz.Write(content)
+	gz.Close()
+
+	const plainHash = "0123456789abcdef0123456789abcdef01234567"
+	const gzipHash = "89abcdef0123456789abcdef0123456789abcdef"
+	for _, object := range []struct {
+		hash     string
+		data     []byte
+		encoding string
+	}{
+		{plainHash, content, ""},
+		{gzipHash, gzipped.Bytes(), "gzip"},
+	} {
+		w := bucket.Object("prefix/" + object.hash[:2] + "/" + object.hash[2:4] + "/" + object.hash).NewWriter(ctx)
+		w.ContentEncoding = object.encoding
+		if _, err := w.Write(object.data); err != nil {
+			t.Fatalf("Unable to upload object: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Unable to upload object: %v", err)
+		}
+	}
+
+	src, err := newGCSSourceFromURL("gs://"+bucketName+"/prefix", Options{"gcs_spool_memory": "4"})
+	if err != nil {
+		t.Fatalf("Unable to create source: %v", err)
+	}
+	defer src.Close()
+
+	if err := src.(Validator).Validate(ctx); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+
+	for _, hash := range []string{plainHash, gzipHash} {
+		reader, err := src.Open(ctx, hash)
+		if err != nil {
+			t.Errorf("%s: unable to open file: %v", hash, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil || !bytes.Equal(got, content) || reader.Size() != int64(len(content)) {
+			t.Errorf("%s: read '%s' of size %d (%v), expected '%s'", hash, got, reader.Size(), err, content)
+		}
+	}
+
+	info, err := src.Stat(ctx, plainHash)
+	if err != nil || info.Size != int64(len(content)) {
+		t.Errorf("Stat returned %+v (%v), expected size %d", info, err, len(content))
+	}
+	info, err = src.Stat(ctx, gzipHash)
+	if err != nil || info.Size != -1 {
+		t.Errorf("Stat returned %+v (%v) for an encoded object, expected an unknown size", info, err)
+	}
+
+	if _, err := src.Open(ctx, strings.Repeat("f", 40)); !IsNotFound(err) {
+		t.Errorf("Expected a NotFoundError for a missing file, got %v", err)
+	}
+
+	missing, err := newGCSSourceFromURL("gs://"+bucketName+"-missing", Options{})
+	if err != nil {
+		t.Fatalf("Unable to create source: %v", err)
+	}
+	if err := missing.(Validator).Validate(ctx); err == nil {
+		t.Errorf("Expected Validate to fail for a missing bucket")
+	}
+}
+
+// vim: nolist expandtab ts=4 sw=4
@@ -1,16 +1,24 @@
 package source
 
 import (
+	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
-
-	"moodle-backup-filler/config"
 )
 
+func init() {
+	Register("http", newHTTPSourceFromURL)
+	Register("https", newHTTPSourceFromURL)
+}
+
 // httpClient is largely the same as the default http.Client, but has a
 // couple of timeout tweaks (ResponseHeaderTimeout and
 // ExpectContinueTimeout).
@@ -31,6 +39,188 @@ var httpClient = &http.Client{
 	},
 }
 
+// HTTPOptions configures an HTTPSource.
+type HTTPOptions struct {
+	// Base is the URL the content hash is appended to.
+	Base string
+
+	// Client is used for requests.  If nil, a client with timeouts suited
+	// to reading Moodle content is used.
+	Client *http.Client
+
+	// Responses without a Content-Length (chunked or compressed) have to
+	// be read in full before their size is known.  Up to SpoolMemoryLimit
+	// bytes (default 8MiB) are held in memory, and larger responses are
+	// spooled to a temporary file in SpoolDir (default the system
+	// temporary directory), up to SpoolMaxSize bytes (0 for no limit).
+	SpoolMemoryLimit int64
+	SpoolMaxSize     int64
+	SpoolDir         string
+}
+
+// HTTPSource implements the ContentSource interface for files served over
+// HTTP, at URLs formed by appending the content hash to a base URL.
+type HTTPSource struct {
+	opts HTTPOptions
+}
+
+// NewHTTPSource returns a ContentSource for files beneath the URL base.  If
+// client is nil, a client with timeouts suited to reading Moodle content is
+// used.
+func NewHTTPSource(base string, client *http.Client) *HTTPSource {
+	return NewHTTPSourceWithOptions(HTTPOptions{
+		Base:   base,
+		Client: client,
+	})
+}
+
+// NewHTTPSourceWithOptions returns a ContentSource for files beneath the URL
+// described by opts.
+func NewHTTPSourceWithOptions(opts HTTPOptions) *HTTPSource {
+	if !strings.HasSuffix(opts.Base, "/") {
+		opts.Base = opts.Base + "/"
+	}
+	if opts.Client == nil {
+		opts.Client = httpClient
+	}
+	if opts.SpoolMemoryLimit <= 0 {
+		opts.SpoolMemoryLimit = 8 << 20
+	}
+
+	return &HTTPSource{opts: opts}
+}
+
+// newHTTPSourceFromURL is the Factory for http:// and https:// content
+// bases.  The http_spool_memory, http_spool_max_size and http_spool_dir
+// options are optional.
+func newHTTPSourceFromURL(base string, opts Options) (ContentSource, error) {
+	contentURL, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("contentbase '%s' is not a valid URL: %v", base, err)
+	}
+	if contentURL.Host == "" {
+		return nil, fmt.Errorf("contentbase '%s' does not include a host name", base)
+	}
+
+	httpOpts := HTTPOptions{
+		Base:     base,
+		SpoolDir: opts["http_spool_dir"],
+	}
+	for key, value := range map[string]*int64{
+		"http_spool_memory":   &httpOpts.SpoolMemoryLimit,
+		"http_spool_max_size": &httpOpts.SpoolMaxSize,
+	} {
+		if opt := opts[key]; opt != "" {
+			*value, err = strconv.ParseInt(opt, 10, 64)
+			if err != nil || *value < 0 {
+				return nil, fmt.Errorf("%s '%s' must be a number of bytes", key, opt)
+			}
+		}
+	}
+
+	return NewHTTPSourceWithOptions(httpOpts), nil
+}
+
+// Name returns "http".
+func (s *HTTPSource) Name() string {
+	return "http"
+}
+
+// Open returns a ContentReader for the file with hash contentHash.  If the
+// server doesn't say how large the file is, it's spooled so that its size
+// is known before it's read.
+func (s *HTTPSource) Open(ctx context.Context, contentHash string) (ContentReader, error) {
+	reader, err := NewHTTPContentReader(ctx, s.opts.Client, s.opts.Base+contentHash)
+	if err != nil {
+		return nil, err
+	}
+	if reader.Size() >= 0 {
+		return reader, nil
+	}
+
+	return s.spool(reader)
+}
+
+// spool reads the whole of reader, which is closed, into memory or a
+// temporary file, returning a ContentReader for the copy.
+func (s *HTTPSource) spool(reader *HTTPContentReader) (*HTTPContentReader, error) {
+	defer reader.Close()
+
+	copied, size, err := spool(reader, s.opts.SpoolMemoryLimit, s.opts.SpoolMaxSize, s.opts.SpoolDir, "http_spool_max_size")
+	if err != nil {
+		return nil, err
+	}
+
+	return &HTTPContentReader{
+		reader: copied,
+		size:   size,
+	}, nil
+}
+
+// Stat returns information about the file with hash contentHash, using a
+// HEAD request.
+func (s *HTTPSource) Stat(ctx context.Context, contentHash string) (*FileInfo, error) {
+	req, err := http.NewRequest("HEAD", s.opts.Base+contentHash, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.opts.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return nil, &NotFoundError{Message: fmt.Sprintf("Received status code '%d' while checking '%s'", resp.StatusCode, req.URL)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Received status code '%d' while checking '%s'", resp.StatusCode, req.URL)
+	}
+
+	size := resp.ContentLength
+	if resp.Header.Get("Content-Encoding") != "" {
+		// the length of the encoded file, not the file itself
+		size = -1
+	}
+
+	return &FileInfo{
+		Size:     size,
+		Location: req.URL.String(),
+	}, nil
+}
+
+// Close closes any idle connections to the HTTP server.
+func (s *HTTPSource) Close() error {
+	if transport, ok := s.opts.Client.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+
+	return nil
+}
+
+// Validate confirms that the HTTP server for the base URL responds.  Any
+// response short of a server error is accepted, since the server needn't
+// serve anything at the base URL itself.
+func (s *HTTPSource) Validate(ctx context.Context) error {
+	req, err := http.NewRequest("HEAD", s.opts.Base, nil)
+	if err != nil {
+		return fmt.Errorf("contentbase '%s' is not a valid URL: %v", s.opts.Base, err)
+	}
+
+	resp, err := s.opts.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("Unable to reach contentbase '%s', check the URL and network access: %v", s.opts.Base, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("contentbase '%s' responded with server error '%s'", s.opts.Base, resp.Status)
+	}
+
+	return nil
+}
+
 // HTTPContentReader implements the ContentReader interface for files
 // accessible through HTTP.
 type HTTPContentReader struct {
@@ -38,15 +228,16 @@ type HTTPContentReader struct {
 	size   int64
 }
 
-// NewHTTPContentReader returns a ContentReader for the given contentHash,
-// which reads the file from an HTTP endpoint.
-func NewHTTPContentReader(contentHash string) (*HTTPContentReader, error) {
-	req, err := http.NewRequest("GET", config.Config.ContentBase+"/"+contentHash, nil)
+// NewHTTPContentReader returns a ContentReader which reads the file at url
+// using client.  A gzip encoded response is decoded, so its Size is -1, as
+// it is for any response without a Content-Length.
+func NewHTTPContentReader(ctx context.Context, client *http.Client, url string) (*HTTPContentReader, error) {
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := httpClient.Do(req)
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -54,7 +245,31 @@ func NewHTTPContentReader(contentHash string) (*HTTPContentReader, error) {
 	if resp.StatusCode != http.StatusOK {
 		io.Copy(ioutil.Discard, resp.Body)
 		resp.Body.Close()
-		return nil, fmt.Errorf("Received status code '%d' while reading '%s'", resp.StatusCode, contentHash)
+		message := fmt.Sprintf("Received status code '%d' while reading '%s'", resp.StatusCode, url)
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+			return nil, &NotFoundError{Message: message}
+		}
+		return nil, fmt.Errorf("%s", message)
+	}
+
+	switch resp.Header.Get("Content-Encoding") {
+	case "":
+	case "gzip", "x-gzip":
+		// only when the server compressed the file unasked, as
+		// http.Transport removes the header when it decodes the response
+		// itself
+		gzipReader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("Unable to decode gzip response while reading '%s': %v", url, err)
+		}
+		return &HTTPContentReader{
+			reader: &gzipBody{Reader: gzipReader, body: resp.Body},
+			size:   -1,
+		}, nil
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("Unsupported Content-Encoding '%s' while reading '%s'", resp.Header.Get("Content-Encoding"), url)
 	}
 
 	return &HTTPContentReader{
@@ -63,7 +278,21 @@ func NewHTTPContentReader(contentHash string) (*HTTPContentReader, error) {
 	}, nil
 }
 
-// Size returns the size of the currently open file.
+// gzipBody decodes a gzip encoded response body.
+type gzipBody struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+// Close closes the decoder and the response body.
+func (gb *gzipBody) Close() error {
+	gb.Reader.Close()
+
+	return gb.body.Close()
+}
+
+// Size returns the size of the currently open file, or -1 if the server
+// didn't say.
 func (cr *HTTPContentReader) Size() int64 {
 	return cr.size
 }
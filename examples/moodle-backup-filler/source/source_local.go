@@ -1,13 +1,203 @@
 package source
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
-	"moodle-backup-filler/config"
+	"moodle-backup-filler/logger"
 )
 
-// LocalContentReader implements the ContentSource interface for files
+func init() {
+	Register("file", newLocalSourceFromURL)
+}
+
+// Layouts of files within a local root, as accepted by LocalOptions.
+const (
+	// LayoutMoodle is the standard Moodle layout, aa/bb/aabbcc...
+	LayoutMoodle = "moodle"
+
+	// LayoutOneLevel has a single level of directories, aa/aabbcc...
+	LayoutOneLevel = "one-level"
+
+	// LayoutFlat has all files in the root itself, aabbcc...
+	LayoutFlat = "flat"
+)
+
+// LocalOptions configures a LocalSource.
+type LocalOptions struct {
+	// Roots are the directories searched for each file, in order, e.g. a
+	// Moodle filedir followed by its trashdir.
+	Roots []string
+
+	// Layouts are the layouts tried in each root, in order, defaulting to
+	// LayoutMoodle.
+	Layouts []string
+}
+
+// LocalSource implements the ContentSource interface for files stored on
+// local disk, by default using the standard Moodle data directory layout.
+// Files are looked for in each root in turn, so that files deleted from
+// Moodle can still be found in its trash directory.
+type LocalSource struct {
+	opts LocalOptions
+}
+
+// newLocalSourceFromURL is the Factory for local paths and file:// content
+// bases.  Several roots can be given, separated by commas.  The
+// local_layouts option is a comma separated list of layouts to try.
+func newLocalSourceFromURL(base string, opts Options) (ContentSource, error) {
+	return NewLocalSourceWithOptions(LocalOptions{
+		Roots:   splitList(strings.TrimPrefix(base, "file://")),
+		Layouts: splitList(opts["local_layouts"]),
+	})
+}
+
+// splitList splits a comma separated list, ignoring empty items.
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// NewLocalSource returns a ContentSource for the Moodle file directory base.
+func NewLocalSource(base string) *LocalSource {
+	return &LocalSource{
+		opts: LocalOptions{
+			Roots:   []string{base},
+			Layouts: []string{LayoutMoodle},
+		},
+	}
+}
+
+// NewLocalSourceWithOptions returns a ContentSource for files in the roots
+// described by opts.
+func NewLocalSourceWithOptions(opts LocalOptions) (*LocalSource, error) {
+	if len(opts.Roots) == 0 {
+		return nil, fmt.Errorf("No directories provided for local content source")
+	}
+	if len(opts.Layouts) == 0 {
+		opts.Layouts = []string{LayoutMoodle}
+	}
+	for _, layout := range opts.Layouts {
+		switch layout {
+		case LayoutMoodle, LayoutOneLevel, LayoutFlat:
+		default:
+			return nil, fmt.Errorf("local_layouts '%s' must be one of %s, %s or %s", layout, LayoutMoodle, LayoutOneLevel, LayoutFlat)
+		}
+	}
+
+	return &LocalSource{opts: opts}, nil
+}
+
+// Name returns "local".
+func (s *LocalSource) Name() string {
+	return "local"
+}
+
+// find returns the root containing the file with hash contentHash, and the
+// file's path and information.  The error returned if it isn't found is
+// the one for the first root and layout.
+func (s *LocalSource) find(contentHash string) (string, string, os.FileInfo, error) {
+	var firstErr error
+	for _, root := range s.opts.Roots {
+		for _, layout := range s.opts.Layouts {
+			filePath := localContentPath(root, layout, contentHash)
+			fileInfo, err := os.Stat(filePath)
+			if err == nil {
+				return root, filePath, fileInfo, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return "", "", nil, firstErr
+}
+
+// Open returns a ContentReader for the file with hash contentHash, from the
+// first root containing it.
+func (s *LocalSource) Open(ctx context.Context, contentHash string) (ContentReader, error) {
+	root, filePath, fileInfo, err := s.find(contentHash)
+	if err != nil {
+		return nil, err
+	}
+	logger.FromContext(ctx).WithField("root", root).Debugf("Found file '%s' at '%s'", contentHash, filePath)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalContentReader{
+		file: file,
+		size: fileInfo.Size(),
+	}, nil
+}
+
+// Stat returns information about the file with hash contentHash, whose
+// Location shows which root it was found in.
+func (s *LocalSource) Stat(ctx context.Context, contentHash string) (*FileInfo, error) {
+	_, filePath, fileInfo, err := s.find(contentHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileInfo{
+		Size:     fileInfo.Size(),
+		Location: filePath,
+	}, nil
+}
+
+// Close does nothing, since files are closed as they're read.
+func (s *LocalSource) Close() error {
+	return nil
+}
+
+// Validate confirms that the first root, normally the Moodle file
+// directory, exists.  Later roots such as the trash directory may not exist
+// yet, so are only warned about.
+func (s *LocalSource) Validate(ctx context.Context) error {
+	for i, root := range s.opts.Roots {
+		fileInfo, err := os.Stat(root)
+		if err == nil && !fileInfo.IsDir() {
+			err = fmt.Errorf("contentbase '%s' is not a directory", root)
+		}
+		if err != nil && i == 0 {
+			return err
+		}
+		if err != nil {
+			logger.FromContext(ctx).WithError(err).Warnf("Unable to use contentbase directory '%s'", root)
+		}
+	}
+
+	return nil
+}
+
+// localContentPath returns the path of the file with hash contentHash in
+// the directory root using layout.
+func localContentPath(root, layout, contentHash string) string {
+	paddedHash := contentHash + "____" // ensure slices below don't fail if contentHash is invalid
+
+	switch layout {
+	case LayoutOneLevel:
+		return filepath.Join(root, paddedHash[:2], contentHash)
+	case LayoutFlat:
+		return filepath.Join(root, contentHash)
+	default:
+		return filepath.Join(root, paddedHash[:2], paddedHash[2:4], contentHash)
+	}
+}
+
+// LocalContentReader implements the ContentReader interface for files
 // stored on local disk using the standard Moodle data directory layout.
 type LocalContentReader struct {
 	file *os.File
@@ -15,9 +205,9 @@ type LocalContentReader struct {
 }
 
 // NewLocalContentReader returns a ContentReader for the given contentHash,
-// which reads the file from local disk.
-func NewLocalContentReader(contentHash string) (*LocalContentReader, error) {
-	filePath := filepath.Join(config.Config.ContentBase, contentHash[:2], contentHash[2:4], contentHash)
+// which reads the file from the Moodle file directory base.
+func NewLocalContentReader(base, contentHash string) (*LocalContentReader, error) {
+	filePath := localContentPath(base, LayoutMoodle, contentHash)
 
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
@@ -1,12 +1,24 @@
 package source
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	// AWS
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
@@ -14,14 +26,112 @@ import (
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/net/http/httpproxy"
 
-	"moodle-backup-filler/config"
 	"moodle-backup-filler/source/s3"
 )
 
-var (
-	s3Client *S3Client
-)
+// s3BucketPattern matches valid S3 bucket names.
+var s3BucketPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+func init() {
+	Register("s3", newS3SourceFromURL)
+}
+
+// S3Options configures an S3Source.
+type S3Options struct {
+	// Bucket is the name of the bucket from which to read files.
+	Bucket string
+
+	// Prefix is prepended to the key of each file in the bucket.  If not
+	// empty, it should end with a slash.
+	Prefix string
+
+	// Region is the AWS region of the bucket.
+	Region string
+
+	// AssumeRoleARN is the ARN of a role to assume for access to the
+	// bucket, if the credentials found in the environment or EC2 instance
+	// metadata don't have access themselves.  Several ARNs may be given,
+	// separated by commas, to chain roles: each role is assumed using the
+	// credentials of the one before.
+	AssumeRoleARN string
+
+	// AssumeRole configures how roles are assumed.
+	AssumeRole S3AssumeRoleOptions
+
+	// Transport tunes the HTTP connections to S3.
+	Transport S3TransportOptions
+
+	// Restore configures the restoring of archived objects.
+	Restore S3RestoreOptions
+
+	// Endpoint overrides the S3 endpoint, for S3 compatible services.
+	// Buckets are then addressed by path rather than host name.
+	Endpoint string
+}
+
+// S3AssumeRoleOptions configures how the roles in S3Options.AssumeRoleARN
+// are assumed.
+type S3AssumeRoleOptions struct {
+	// ExternalID is passed when assuming each role, for roles whose trust
+	// policy requires one.
+	ExternalID string
+
+	// SessionName identifies the role sessions in CloudTrail, defaulting
+	// to "moodle-backup-filler".
+	SessionName string
+
+	// Duration is how long the credentials for the first role last before
+	// they're refreshed, defaulting to 15 minutes.  AWS limits chained
+	// roles to an hour, so later roles use the lesser of Duration and an
+	// hour.
+	Duration time.Duration
+
+	// MFASerial is the serial number or ARN of an MFA device, required by
+	// the first role.  The code is MFATokenCode if provided, otherwise it's
+	// read from the terminal (/dev/tty) whenever the first role's session
+	// is renewed.  A code can only be used once, so with MFATokenCode the
+	// credentials can't be renewed once Duration has passed.
+	MFASerial    string
+	MFATokenCode string
+}
+
+// roleSessionNamePattern matches valid role session names.
+var roleSessionNamePattern = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+
+// maxChainedRoleDuration is the longest AWS allows credentials for a role
+// assumed using another role's credentials to last.
+const maxChainedRoleDuration = time.Hour
+
+// S3TransportOptions tunes the HTTP connections to S3.  Zero values are
+// replaced with the defaults given.
+type S3TransportOptions struct {
+	// MaxConns is the number of connections to S3 that may be open at
+	// once, all of which are kept open for reuse when idle.  Default 64.
+	MaxConns int
+
+	// DialTimeout, TLSHandshakeTimeout and ResponseHeaderTimeout limit
+	// the time taken to connect, to negotiate TLS, and for S3 to start
+	// responding once a request is sent.  Defaults 30s, 10s and 30s.
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	// IdleConnTimeout is how long an idle connection is kept for reuse,
+	// and KeepAlive is the interval between TCP keep-alive probes.
+	// Defaults 90s and 30s.  DisableKeepAlives uses a new connection for
+	// every request.
+	IdleConnTimeout   time.Duration
+	KeepAlive         time.Duration
+	DisableKeepAlives bool
+
+	// Proxy is the URL of an HTTP proxy for requests to S3, and NoProxy a
+	// comma separated list of hosts not to use it for.  They default to
+	// the HTTPS_PROXY and NO_PROXY environment variables.
+	Proxy   string
+	NoProxy string
+}
 
 // S3Client provides a persistent S3 session across multiple S3ContentReader
 // objects.
@@ -33,32 +143,103 @@ type S3Client struct {
 	s3Client    *s3wrapper.S3
 }
 
-func newS3Client() (*S3Client, error) {
+// NewS3HTTPClient returns an http.Client for requests to S3, configured by
+// opts, which pools connections for concurrent requests.
+func NewS3HTTPClient(opts S3TransportOptions) (*http.Client, error) {
+	if opts.MaxConns <= 0 {
+		opts.MaxConns = 64
+	}
+	for _, d := range []struct {
+		value        *time.Duration
+		defaultValue time.Duration
+	}{
+		{&opts.DialTimeout, 30 * time.Second},
+		{&opts.TLSHandshakeTimeout, 10 * time.Second},
+		{&opts.ResponseHeaderTimeout, 30 * time.Second},
+		{&opts.IdleConnTimeout, 90 * time.Second},
+		{&opts.KeepAlive, 30 * time.Second},
+	} {
+		if *d.value <= 0 {
+			*d.value = d.defaultValue
+		}
+	}
+
+	proxyConfig := httpproxy.FromEnvironment()
+	if opts.Proxy != "" {
+		if _, err := url.Parse(opts.Proxy); err != nil {
+			return nil, fmt.Errorf("s3_proxy '%s' is not a valid URL: %v", opts.Proxy, err)
+		}
+		proxyConfig.HTTPProxy = opts.Proxy
+		proxyConfig.HTTPSProxy = opts.Proxy
+	}
+	if opts.NoProxy != "" {
+		proxyConfig.NoProxy = opts.NoProxy
+	}
+	proxyFunc := proxyConfig.ProxyFunc()
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(req *http.Request) (*url.URL, error) {
+				return proxyFunc(req.URL)
+			},
+			DialContext: (&net.Dialer{
+				Timeout:   opts.DialTimeout,
+				KeepAlive: opts.KeepAlive,
+				DualStack: true,
+			}).DialContext,
+			// the default of 2 idle connections per host means most
+			// connections are closed after one request when files are
+			// read concurrently
+			MaxConnsPerHost:       opts.MaxConns,
+			MaxIdleConns:          opts.MaxConns,
+			MaxIdleConnsPerHost:   opts.MaxConns,
+			IdleConnTimeout:       opts.IdleConnTimeout,
+			DisableKeepAlives:     opts.DisableKeepAlives,
+			TLSHandshakeTimeout:   opts.TLSHandshakeTimeout,
+			ResponseHeaderTimeout: opts.ResponseHeaderTimeout,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}, nil
+}
+
+func newS3Client(opts S3Options) (*S3Client, error) {
 	c := &S3Client{}
 
+	httpClient, err := NewS3HTTPClient(opts.Transport)
+	if err != nil {
+		return nil, err
+	}
+
 	c.credentials = credentials.NewChainCredentials([]credentials.Provider{
 		&credentials.EnvProvider{},
 		&ec2rolecreds.EC2RoleProvider{Client: ec2metadata.New(session.New())},
 	})
 
 	if _, err := c.credentials.Get(); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Unable to find AWS credentials in the environment or EC2 instance metadata: %v", err)
 	}
 
 	c.awsConfig = &aws.Config{
 		Credentials: c.credentials,
-		HTTPClient:  http.DefaultClient,
-		Region:      aws.String(config.Config.S3Region),
+		HTTPClient:  httpClient,
+		Region:      aws.String(opts.Region),
+	}
+	if opts.Endpoint != "" {
+		c.awsConfig.Endpoint = aws.String(opts.Endpoint)
+		c.awsConfig.S3ForcePathStyle = aws.Bool(true)
 	}
 
-	session, err := session.NewSession(c.awsConfig)
+	sess, err := session.NewSession(c.awsConfig)
 	if err != nil {
 		return nil, err
 	}
-	c.session = session
+	c.session = sess
 
-	if config.Config.S3AssumeRoleARN != "" {
-		c.stsCreds = stscreds.NewCredentials(c.session, config.Config.S3AssumeRoleARN)
+	if opts.AssumeRoleARN != "" {
+		c.stsCreds, err = assumeRoles(sess, c.awsConfig, opts)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if c.stsCreds != nil {
@@ -70,31 +251,373 @@ func newS3Client() (*S3Client, error) {
 	return c, nil
 }
 
-// S3ContentReader implements the ContentReader interface for files
-// contained in an S3 bucket.
-type S3ContentReader struct {
-	reader io.ReadCloser
-	size   int64
+// assumeRoles returns credentials for the last of the roles in
+// opts.AssumeRoleARN, each assumed using the credentials of the one before,
+// starting with sess.  awsConfig is the configuration of sess, used for the
+// sessions of chained roles.  Credentials are only requested from STS when
+// first used, and are refreshed a minute before they expire.
+func assumeRoles(sess client.ConfigProvider, awsConfig *aws.Config, opts S3Options) (*credentials.Credentials, error) {
+	roleOpts := opts.AssumeRole
+	if roleOpts.SessionName == "" {
+		roleOpts.SessionName = "moodle-backup-filler"
+	}
+	if !roleSessionNamePattern.MatchString(roleOpts.SessionName) {
+		return nil, fmt.Errorf("s3_assume_role_session_name '%s' must be 2-64 letters, digits or any of +=,.@_-", roleOpts.SessionName)
+	}
+	if roleOpts.Duration <= 0 {
+		roleOpts.Duration = stscreds.DefaultDuration
+	}
+
+	var creds *credentials.Credentials
+	for _, roleARN := range strings.Split(opts.AssumeRoleARN, ",") {
+		roleARN = strings.TrimSpace(roleARN)
+		if roleARN == "" {
+			continue
+		}
+
+		first := creds == nil
+		if !first {
+			var err error
+			sess, err = session.NewSession(&aws.Config{
+				Credentials: creds,
+				HTTPClient:  awsConfig.HTTPClient,
+				Region:      awsConfig.Region,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		creds = stscreds.NewCredentials(sess, roleARN, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = roleOpts.SessionName
+			p.Duration = roleOpts.Duration
+			p.ExpiryWindow = time.Minute
+			if roleOpts.ExternalID != "" {
+				p.ExternalID = aws.String(roleOpts.ExternalID)
+			}
+			if !first && p.Duration > maxChainedRoleDuration {
+				p.Duration = maxChainedRoleDuration
+			}
+			if first && roleOpts.MFASerial != "" {
+				p.SerialNumber = aws.String(roleOpts.MFASerial)
+				p.TokenProvider = mfaTokenProvider(roleOpts)
+			}
+		})
+	}
+	if creds == nil {
+		return nil, fmt.Errorf("s3_assume_role_arn '%s' does not include a role ARN", opts.AssumeRoleARN)
+	}
+
+	return creds, nil
+}
+
+// mfaTerminal is where MFA codes are prompted for and read, rather than
+// stdin and stdout, which may be carrying backups.
+var mfaTerminal = "/dev/tty"
+
+// mfaTokenProvider returns a stscreds TokenProvider for the MFA device in
+// opts.  A code given in opts.MFATokenCode is returned once, and asking
+// again (to renew the session) fails, since codes can't be reused.
+// Otherwise a code is read from the terminal each time.
+func mfaTokenProvider(opts S3AssumeRoleOptions) func() (string, error) {
+	if opts.MFATokenCode == "" {
+		return func() (string, error) {
+			return readMFACode(opts.MFASerial)
+		}
+	}
+
+	var mu sync.Mutex
+	used := false
+	return func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if used {
+			return "", fmt.Errorf("Unable to renew role session, s3_assume_role_mfa_token has already been used and MFA codes can't be reused; leave it unset to be asked for a new code, or increase s3_assume_role_duration")
+		}
+		used = true
+		return opts.MFATokenCode, nil
+	}
 }
 
-// NewS3ContentReader returns a ContentReader for the given contentHash,
-// which reads the file from S3.
-func NewS3ContentReader(contentHash string) (*S3ContentReader, error) {
-	if s3Client == nil {
-		c, err := newS3Client()
+// readMFACode prompts for a code for the MFA device serial on the terminal,
+// and reads it from there.
+func readMFACode(serial string) (string, error) {
+	tty, err := os.OpenFile(mfaTerminal, os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("Unable to ask for an MFA code without a terminal, provide s3_assume_role_mfa_token: %v", err)
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "MFA code for %s: ", serial)
+	var code string
+	if _, err := fmt.Fscanln(tty, &code); err != nil {
+		return "", fmt.Errorf("Unable to read MFA code: %v", err)
+	}
+
+	return code, nil
+}
+
+// S3Source implements the ContentSource interface for files stored in an S3
+// bucket using the standard Moodle layout.
+type S3Source struct {
+	opts   S3Options
+	client *S3Client
+
+	// archived is set (atomically) once Open finds an archived file, after
+	// which Prepare checks every file
+	archived int32
+}
+
+// NewS3Source returns a ContentSource for files in the bucket described by
+// opts.  AWS credentials are resolved immediately.
+func NewS3Source(opts S3Options) (*S3Source, error) {
+	switch opts.Restore.Tier {
+	case "", s3.TierExpedited, s3.TierStandard, s3.TierBulk:
+	default:
+		return nil, fmt.Errorf("s3_restore_tier '%s' must be one of %s, %s or %s", opts.Restore.Tier, s3.TierExpedited, s3.TierStandard, s3.TierBulk)
+	}
+	if opts.Restore.Days <= 0 {
+		opts.Restore.Days = 7
+	}
+	if opts.Restore.PollInterval <= 0 {
+		opts.Restore.PollInterval = time.Minute
+	}
+
+	c, err := newS3Client(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Source{
+		opts:   opts,
+		client: c,
+	}, nil
+}
+
+// newS3SourceFromURL is the Factory for s3://bucket/prefix content bases.
+// The s3_region option is required, and s3_assume_role_arn and the
+// transport options (s3_max_conns, timeouts in seconds, s3_proxy etc.) are
+// optional.
+func newS3SourceFromURL(base string, opts Options) (ContentSource, error) {
+	parts := strings.SplitN(strings.TrimPrefix(base, "s3://"), "/", 2)
+	s3Opts := S3Options{
+		Bucket:        parts[0],
+		Region:        opts["s3_region"],
+		AssumeRoleARN: opts["s3_assume_role_arn"],
+		AssumeRole: S3AssumeRoleOptions{
+			ExternalID:   opts["s3_assume_role_external_id"],
+			SessionName:  opts["s3_assume_role_session_name"],
+			MFASerial:    opts["s3_assume_role_mfa_serial"],
+			MFATokenCode: opts["s3_assume_role_mfa_token"],
+		},
+		Transport: S3TransportOptions{
+			Proxy:   opts["s3_proxy"],
+			NoProxy: opts["s3_no_proxy"],
+		},
+	}
+	if len(parts) > 1 {
+		if prefix := strings.Trim(parts[1], "/"); prefix != "" {
+			s3Opts.Prefix = prefix + "/"
+		}
+	}
+
+	if !s3BucketPattern.MatchString(s3Opts.Bucket) {
+		return nil, fmt.Errorf("contentbase '%s' does not include a valid S3 bucket name", base)
+	}
+	if s3Opts.Region == "" {
+		return nil, fmt.Errorf("s3_region is required when contentbase is an S3 bucket")
+	}
+
+	if maxConns := opts["s3_max_conns"]; maxConns != "" {
+		n, err := strconv.Atoi(maxConns)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("s3_max_conns '%s' must be a number of connections, or 0 for the default", maxConns)
+		}
+		s3Opts.Transport.MaxConns = n
+	}
+	for key, value := range map[string]*time.Duration{
+		"s3_dial_timeout":            &s3Opts.Transport.DialTimeout,
+		"s3_tls_handshake_timeout":   &s3Opts.Transport.TLSHandshakeTimeout,
+		"s3_response_header_timeout": &s3Opts.Transport.ResponseHeaderTimeout,
+		"s3_idle_conn_timeout":       &s3Opts.Transport.IdleConnTimeout,
+		"s3_keep_alive":              &s3Opts.Transport.KeepAlive,
+	} {
+		if opt := opts[key]; opt != "" {
+			seconds, err := strconv.Atoi(opt)
+			if err != nil || seconds < 0 {
+				return nil, fmt.Errorf("%s '%s' must be a number of seconds", key, opt)
+			}
+			*value = time.Duration(seconds) * time.Second
+		}
+	}
+	if duration := opts["s3_assume_role_duration"]; duration != "" {
+		seconds, err := strconv.Atoi(duration)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("s3_assume_role_duration '%s' must be a number of seconds", duration)
+		}
+		s3Opts.AssumeRole.Duration = time.Duration(seconds) * time.Second
+	}
+	s3Opts.Restore.Tier = opts["s3_restore_tier"]
+	if scan := opts["s3_restore_scan"]; scan != "" {
+		b, err := strconv.ParseBool(scan)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("s3_restore_scan '%s' must be true or false", scan)
+		}
+		s3Opts.Restore.Scan = b
+	}
+	if days := opts["s3_restore_days"]; days != "" {
+		n, err := strconv.ParseInt(days, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("s3_restore_days '%s' must be a number of days", days)
+		}
+		s3Opts.Restore.Days = n
+	}
+	for key, value := range map[string]*time.Duration{
+		"s3_restore_wait":          &s3Opts.Restore.Wait,
+		"s3_restore_poll_interval": &s3Opts.Restore.PollInterval,
+	} {
+		if opt := opts[key]; opt != "" {
+			seconds, err := strconv.Atoi(opt)
+			if err != nil || seconds < 0 {
+				return nil, fmt.Errorf("%s '%s' must be a number of seconds", key, opt)
+			}
+			*value = time.Duration(seconds) * time.Second
+		}
+	}
+	if disable := opts["s3_disable_keep_alives"]; disable != "" {
+		b, err := strconv.ParseBool(disable)
+		if err != nil {
+			return nil, fmt.Errorf("s3_disable_keep_alives '%s' must be true or false", disable)
 		}
-		s3Client = c
+		s3Opts.Transport.DisableKeepAlives = b
 	}
 
+	return NewS3Source(s3Opts)
+}
+
+// Name returns "s3".
+func (s *S3Source) Name() string {
+	return "s3"
+}
+
+// Open returns a ContentReader for the file with hash contentHash.  If the
+// file is archived and a restore tier is configured, a restore is requested
+// and a *PendingError returned, otherwise an *UnavailableError is returned.
+func (s *S3Source) Open(ctx context.Context, contentHash string) (ContentReader, error) {
+	key := s.contentKey(contentHash)
+
+	reader, err := NewS3ContentReader(ctx, s.client, s.opts.Bucket, key)
+	if isArchivedError(err) {
+		atomic.StoreInt32(&s.archived, 1)
+	}
+	if isArchivedError(err) && s.opts.Restore.Tier != "" {
+		if err := s.requestRestore(ctx, key); err != nil {
+			return nil, fmt.Errorf("Unable to restore '%s' from archive: %v", key, err)
+		}
+		return nil, &PendingError{
+			ContentHashes: []string{contentHash},
+			Reason:        fmt.Sprintf("being restored from S3 archive (%s tier)", s.opts.Restore.Tier),
+		}
+	}
+	if isArchivedError(err) {
+		return nil, &UnavailableError{Message: fmt.Sprintf("Object '%s' is archived, set s3_restore_tier to have it restored", key)}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// Stat returns information about the file with hash contentHash, using a
+// HEAD request.
+func (s *S3Source) Stat(ctx context.Context, contentHash string) (*FileInfo, error) {
+	key := s.contentKey(contentHash)
+
+	response, err := s.client.s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.opts.Bucket),
+		Key:    aws.String(key),
+	})
+	if isS3NotFoundError(err) {
+		return nil, &NotFoundError{Message: err.Error()}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileInfo{
+		Size:     aws.Int64Value(response.ContentLength),
+		Location: fmt.Sprintf("s3://%s/%s", s.opts.Bucket, key),
+	}, nil
+}
+
+// Close closes any idle connections to S3.
+func (s *S3Source) Close() error {
+	if transport, ok := s.client.awsConfig.HTTPClient.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+
+	return nil
+}
+
+// Validate confirms that credentials for the bucket can be resolved
+// (including assuming AssumeRoleARN), and that the bucket exists, is in the
+// configured region and is accessible.
+func (s *S3Source) Validate(ctx context.Context) error {
+	if s.client.stsCreds != nil {
+		if _, err := s.client.stsCreds.Get(); err != nil {
+			return fmt.Errorf("Unable to assume role '%s', check s3_assume_role_arn, that it trusts your credentials, and any external ID or MFA it requires: %v", s.opts.AssumeRoleARN, err)
+		}
+	}
+
+	_, err := s.client.s3Client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.opts.Bucket),
+	})
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch reqErr.StatusCode() {
+		case http.StatusMovedPermanently:
+			return fmt.Errorf("S3 bucket '%s' is not in region '%s', check s3_region", s.opts.Bucket, s.opts.Region)
+		case http.StatusForbidden:
+			return fmt.Errorf("Access denied to S3 bucket '%s', check s3_assume_role_arn and the bucket name", s.opts.Bucket)
+		case http.StatusNotFound:
+			return fmt.Errorf("S3 bucket '%s' does not exist, check contentbase", s.opts.Bucket)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to reach S3 bucket '%s': %v", s.opts.Bucket, err)
+	}
+
+	return nil
+}
+
+// contentKey returns the key of the file with hash contentHash, using the
+// standard Moodle layout beneath the configured prefix.
+func (s *S3Source) contentKey(contentHash string) string {
 	paddedHash := fmt.Sprintf("%s____", contentHash) // ensure slices below don't fail if contentHash is invalid
-	filePath := fmt.Sprintf("/%s/%s/%s", paddedHash[:2], paddedHash[2:4], contentHash)
 
-	response, err := s3Client.s3Client.GetObjectWithRetry(&s3.GetObjectInput{
-		Bucket: &config.Config.S3Bucket,
-		Key:    &filePath,
-	}, 2000, 4) // timeout=2s, retries=4 (30s total since the timeout is doubled each retry)
+	return fmt.Sprintf("%s%s/%s/%s", s.opts.Prefix, paddedHash[:2], paddedHash[2:4], contentHash)
+}
+
+// S3ContentReader implements the ContentReader interface for files
+// contained in an S3 bucket.
+type S3ContentReader struct {
+	reader io.ReadCloser
+	size   int64
+}
+
+// NewS3ContentReader returns a ContentReader which reads the object key
+// from bucket using client.  A single request is made; failures are retried
+// by ResilientSource, and a server that doesn't respond is given up on after
+// the transport's response header timeout.
+func NewS3ContentReader(ctx context.Context, client *S3Client, bucket, key string) (*S3ContentReader, error) {
+	response, err := client.s3Client.GetObjectWithTTFB(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if isS3NotFoundError(err) {
+		return nil, &NotFoundError{Message: err.Error()}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -115,9 +638,23 @@ func (cr *S3ContentReader) Read(b []byte) (int, error) {
 	return cr.reader.Read(b)
 }
 
-// Close closes the currently open file.
+// Close closes the currently open file.  Any small remainder is read first,
+// so that the connection can be reused.
 func (cr *S3ContentReader) Close() error {
+	io.CopyN(ioutil.Discard, cr.reader, 64<<10)
+
 	return cr.reader.Close()
 }
 
+// isS3NotFoundError returns true if err is the error S3 returns for an
+// object that doesn't exist.  HEAD responses have no body, so only have the
+// status code.
+func isS3NotFoundError(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotFound {
+		return true
+	}
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == s3.ErrCodeNoSuchKey
+}
+
 // vim: nolist expandtab ts=4 sw=4
@@ -0,0 +1,191 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"moodle-backup-filler/logger"
+	"moodle-backup-filler/metrics"
+)
+
+// S3RestoreOptions configures the restoring of objects that lifecycle rules
+// have moved to the Glacier or Deep Archive storage classes, which can't be
+// read until a temporary copy is restored.
+type S3RestoreOptions struct {
+	// Tier is the retrieval tier used for restores: "Expedited",
+	// "Standard" or "Bulk".  If empty, archived objects aren't restored,
+	// and are reported as missing.
+	Tier string
+
+	// Days is how long restored copies are kept, defaulting to 7.
+	Days int64
+
+	// Wait is how long to wait for restores to complete before deferring
+	// the backup to a later run.  If zero, backups needing restores are
+	// deferred immediately.
+	Wait time.Duration
+
+	// PollInterval is how often restores are checked while waiting,
+	// defaulting to a minute.
+	PollInterval time.Duration
+
+	// Scan checks the storage class of every file in each backup before
+	// any are read, so that restores are requested together.  Otherwise
+	// that's only done once a file has been found to be archived, so
+	// buckets without archived files aren't sent a HEAD request per file.
+	Scan bool
+}
+
+// s3HeadConcurrency limits the HEAD requests made at once to check the
+// storage class of the files in a backup.
+const s3HeadConcurrency = 16
+
+// Prepare requests restores of any of the files that are archived, and if
+// configured to, waits for them to complete.  If some are still being
+// restored, a *PendingError listing them is returned.  Nothing is done
+// unless a restore tier is configured, and either Scan is set or Open has
+// already found an archived file.
+func (s *S3Source) Prepare(ctx context.Context, contentHashes []string) error {
+	opts := s.opts.Restore
+	if opts.Tier == "" {
+		return nil
+	}
+	if !opts.Scan && atomic.LoadInt32(&s.archived) == 0 {
+		return nil
+	}
+
+	pending := s.restoreArchived(ctx, contentHashes)
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if opts.Wait > 0 {
+		log := logger.FromContext(ctx)
+		log.Infof("Waiting up to %v for %d files to be restored from archive", opts.Wait, len(pending))
+
+		deadline := time.Now().Add(opts.Wait)
+		for len(pending) > 0 && time.Now().Before(deadline) {
+			select {
+			case <-time.After(opts.PollInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			pending = s.restoreArchived(ctx, pending)
+			log.Debugf("%d files still being restored from archive", len(pending))
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	return &PendingError{
+		ContentHashes: pending,
+		Reason:        fmt.Sprintf("being restored from S3 archive (%s tier)", opts.Tier),
+	}
+}
+
+// restoreArchived checks the storage class of each of the files, requesting
+// a restore of those that are archived and haven't been restored, and
+// returns those whose restores haven't completed.  Files that can't be
+// checked are left for Open to report.
+func (s *S3Source) restoreArchived(ctx context.Context, contentHashes []string) []string {
+	log := logger.FromContext(ctx)
+
+	var mu sync.Mutex
+	pending := []string{}
+
+	sem := make(chan struct{}, s3HeadConcurrency)
+	var wg sync.WaitGroup
+	for _, contentHash := range contentHashes {
+		if ctx.Err() != nil {
+			break
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(contentHash string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			key := s.contentKey(contentHash)
+			response, err := s.client.s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+				Bucket: aws.String(s.opts.Bucket),
+				Key:    aws.String(key),
+			})
+			if err != nil {
+				log.WithError(err).Debugf("Unable to check storage class of '%s'", key)
+				return
+			}
+
+			switch aws.StringValue(response.StorageClass) {
+			case "GLACIER", "DEEP_ARCHIVE":
+			default:
+				return
+			}
+
+			restore := aws.StringValue(response.Restore)
+			if strings.Contains(restore, `ongoing-request="false"`) {
+				// restored copy available
+				return
+			}
+			if restore == "" {
+				if err := s.requestRestore(ctx, key); err != nil {
+					log.WithError(err).Warnf("Unable to restore '%s' from archive", key)
+					return
+				}
+			}
+
+			mu.Lock()
+			pending = append(pending, contentHash)
+			mu.Unlock()
+		}(contentHash)
+	}
+	wg.Wait()
+
+	return pending
+}
+
+// requestRestore requests a restore of the archived object key.  A restore
+// already in progress isn't an error.
+func (s *S3Source) requestRestore(ctx context.Context, key string) error {
+	_, err := s.client.s3Client.RestoreObjectWithContext(ctx, &s3.RestoreObjectInput{
+		Bucket: aws.String(s.opts.Bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &s3.RestoreRequest{
+			Days: aws.Int64(s.opts.Restore.Days),
+			GlacierJobParameters: &s3.GlacierJobParameters{
+				Tier: aws.String(s.opts.Restore.Tier),
+			},
+		},
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	metrics.S3RestoresRequested.Inc()
+	logger.FromContext(ctx).Infof("Requested restore of '%s' from archive (%s tier, %d days)", key, s.opts.Restore.Tier, s.opts.Restore.Days)
+
+	return nil
+}
+
+// isArchivedError returns true if err is the error S3 returns when reading
+// an archived object that hasn't been restored.
+func isArchivedError(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && (awsErr.Code() == "InvalidObjectState" || awsErr.Code() == "ObjectNotInActiveTierError")
+}
+
+// vim: nolist expandtab ts=4 sw=4
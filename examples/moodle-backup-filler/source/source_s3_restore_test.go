@@ -0,0 +1,219 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3Object is an object held by fakeS3.  Archived objects can't be read
+// until Restore is `ongoing-request="false"`.
+type fakeS3Object struct {
+	Content  string
+	Archived bool
+	Restore  string
+}
+
+// fakeS3 is an httptest handler for the S3 requests made by S3Source, with
+// path style addressing of a single bucket.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string]*fakeS3Object
+	restores []string
+	heads    int
+
+	// restoreError, if set, is the error code returned for restore
+	// requests
+	restoreError string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	object, ok := f.objects[key]
+	if !ok {
+		f.error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	readable := !object.Archived || strings.Contains(object.Restore, `ongoing-request="false"`)
+
+	switch {
+	case r.Method == "POST" && r.URL.Query()["restore"] != nil:
+		f.restores = append(f.restores, key)
+		if f.restoreError != "" {
+			f.error(w, http.StatusConflict, f.restoreError)
+			return
+		}
+		object.Restore = `ongoing-request="true"`
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "HEAD":
+		f.heads++
+		if object.Archived {
+			w.Header().Set("x-amz-storage-class", "GLACIER")
+		}
+		if object.Restore != "" {
+			w.Header().Set("x-amz-restore", object.Restore)
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(object.Content)))
+	case r.Method == "GET" && !readable:
+		f.error(w, http.StatusForbidden, "InvalidObjectState")
+	case r.Method == "GET":
+		w.Header().Set("Content-Length", fmt.Sprint(len(object.Content)))
+		fmt.Fprint(w, object.Content)
+	default:
+		f.error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// newFakeS3Source returns an S3Source reading from a fakeS3 holding
+// objects, keyed by content hash, and a function that stops the server.
+func newFakeS3Source(t *testing.T, objects map[string]*fakeS3Object, restore S3RestoreOptions) (*S3Source, *fakeS3, func()) {
+	restoreEnv := setTestAWSCredentials()
+
+	fake := &fakeS3{objects: map[string]*fakeS3Object{}}
+	src := &S3Source{opts: S3Options{Bucket: "bucket"}}
+	for contentHash, object := range objects {
+		fake.objects[src.contentKey(contentHash)] = object
+	}
+	server := httptest.NewServer(fake)
+
+	src, err := NewS3Source(S3Options{
+		Bucket:   "bucket",
+		Region:   "us-east-1",
+		Endpoint: server.URL,
+		Restore:  restore,
+	})
+	if err != nil {
+		server.Close()
+		restoreEnv()
+		t.Fatalf("Unable to create source: %v", err)
+	}
+
+	return src, fake, func() {
+		server.Close()
+		restoreEnv()
+	}
+}
+
+const (
+	testHashA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	testHashB = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+func TestS3OpenArchivedRequestsRestore(t *testing.T) {
+	for _, restoreError := range []string{"", "RestoreAlreadyInProgress"} {
+		src, fake, stop := newFakeS3Source(t, map[string]*fakeS3Object{
+			testHashA: {Content: "a", Archived: true},
+		}, S3RestoreOptions{Tier: "Bulk"})
+		fake.restoreError = restoreError
+
+		_, err := src.Open(context.Background(), testHashA)
+		if pending, ok := err.(*PendingError); !ok || len(pending.ContentHashes) != 1 || pending.ContentHashes[0] != testHashA {
+			t.Errorf("%s: expected a *PendingError for '%s', got %v", restoreError, testHashA, err)
+		}
+		if len(fake.restores) != 1 || fake.restores[0] != src.contentKey(testHashA) {
+			t.Errorf("%s: restores requested for %v, expected '%s'", restoreError, fake.restores, src.contentKey(testHashA))
+		}
+		stop()
+	}
+}
+
+func TestS3OpenArchivedWithoutTier(t *testing.T) {
+	src, fake, stop := newFakeS3Source(t, map[string]*fakeS3Object{
+		testHashA: {Content: "a", Archived: true},
+	}, S3RestoreOptions{})
+	defer stop()
+
+	_, err := src.Open(context.Background(), testHashA)
+	if !IsUnavailable(err) {
+		t.Errorf("Expected an *UnavailableError, got %v", err)
+	}
+	if isFailure(context.Background(), err) {
+		t.Errorf("Archived file without a restore tier counted as a failure of the source")
+	}
+	if len(fake.restores) != 0 {
+		t.Errorf("Restores requested for %v without a restore tier", fake.restores)
+	}
+}
+
+func TestS3PrepareOnlyAfterArchivedFound(t *testing.T) {
+	src, fake, stop := newFakeS3Source(t, map[string]*fakeS3Object{
+		testHashA: {Content: "a"},
+		testHashB: {Content: "b", Archived: true},
+	}, S3RestoreOptions{Tier: "Bulk"})
+	defer stop()
+	ctx := context.Background()
+
+	if err := src.Prepare(ctx, []string{testHashA, testHashB}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if fake.heads != 0 {
+		t.Errorf("%d HEAD requests made before any archived file was found", fake.heads)
+	}
+
+	if _, err := src.Open(ctx, testHashB); !IsPending(err) {
+		t.Errorf("Expected a *PendingError, got %v", err)
+	}
+	if err := src.Prepare(ctx, []string{testHashA, testHashB}); !IsPending(err) {
+		t.Errorf("Expected a *PendingError, got %v", err)
+	}
+	if fake.heads != 2 {
+		t.Errorf("%d HEAD requests made once an archived file was found, expected 2", fake.heads)
+	}
+}
+
+func TestS3PrepareRestored(t *testing.T) {
+	src, fake, stop := newFakeS3Source(t, map[string]*fakeS3Object{
+		testHashA: {Content: "a"},
+		testHashB: {Content: "b", Archived: true, Restore: `ongoing-request="false", expiry-date="Fri, 23 Dec 2022 00:00:00 GMT"`},
+	}, S3RestoreOptions{Tier: "Bulk", Scan: true})
+	defer stop()
+
+	if err := src.Prepare(context.Background(), []string{testHashA, testHashB}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if len(fake.restores) != 0 {
+		t.Errorf("Restores requested for %v, which were already restored", fake.restores)
+	}
+}
+
+func TestS3PrepareWaitsUntilDeadline(t *testing.T) {
+	src, fake, stop := newFakeS3Source(t, map[string]*fakeS3Object{
+		testHashA: {Content: "a", Archived: true},
+		testHashB: {Content: "b", Archived: true, Restore: `ongoing-request="true"`},
+	}, S3RestoreOptions{
+		Tier:         "Bulk",
+		Scan:         true,
+		Wait:         50 * time.Millisecond,
+		PollInterval: 10 * time.Millisecond,
+	})
+	defer stop()
+
+	start := time.Now()
+	err := src.Prepare(context.Background(), []string{testHashA, testHashB})
+	pending, ok := err.(*PendingError)
+	if !ok || len(pending.ContentHashes) != 2 {
+		t.Fatalf("Expected a *PendingError for both files, got %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Returned after %v, before the deadline", time.Since(start))
+	}
+	if len(fake.restores) != 1 || fake.restores[0] != src.contentKey(testHashA) {
+		t.Errorf("Restores requested for %v, expected only '%s'", fake.restores, src.contentKey(testHashA))
+	}
+}
+
+// vim: nolist expandtab ts=4 sw=4
@@ -0,0 +1,116 @@
+package source
+
+import (
+	"os"
+	"testing"
+)
+
+// setTestAWSCredentials provides static credentials so that S3 sources can
+// be created without an EC2 instance role, returning a function that
+// restores the environment.
+func setTestAWSCredentials() func() {
+	vars := map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKIDTEST",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_SESSION_TOKEN":     "",
+	}
+	saved := map[string]*string{}
+	for name, value := range vars {
+		if old, ok := os.LookupEnv(name); ok {
+			saved[name] = &old
+		} else {
+			saved[name] = nil
+		}
+		os.Setenv(name, value)
+	}
+
+	return func() {
+		for name, old := range saved {
+			if old == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *old)
+			}
+		}
+	}
+}
+
+func TestS3ContentKey(t *testing.T) {
+	defer setTestAWSCredentials()()
+
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	tests := []struct {
+		base   string
+		bucket string
+		key    string
+	}{
+		{"s3://bucket", "bucket", "01/23/" + hash},
+		{"s3://bucket/", "bucket", "01/23/" + hash},
+		{"s3://bucket/prefix", "bucket", "prefix/01/23/" + hash},
+		{"s3://bucket/prefix/", "bucket", "prefix/01/23/" + hash},
+		{"s3://bucket/moodle/filedir", "bucket", "moodle/filedir/01/23/" + hash},
+		{"s3://bucket/moodle/filedir/", "bucket", "moodle/filedir/01/23/" + hash},
+	}
+
+	for _, test := range tests {
+		src, err := newS3SourceFromURL(test.base, Options{"s3_region": "us-east-1"})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.base, err)
+			continue
+		}
+		s3Src := src.(*S3Source)
+		if s3Src.opts.Bucket != test.bucket {
+			t.Errorf("%s: bucket is '%s', expected '%s'", test.base, s3Src.opts.Bucket, test.bucket)
+		}
+		if key := s3Src.contentKey(hash); key != test.key {
+			t.Errorf("%s: key is '%s', expected '%s'", test.base, key, test.key)
+		}
+	}
+}
+
+func TestS3SourceFromURLErrors(t *testing.T) {
+	defer setTestAWSCredentials()()
+
+	tests := []struct {
+		base string
+		opts Options
+	}{
+		{"s3://", Options{"s3_region": "us-east-1"}},
+		{"s3:///prefix", Options{"s3_region": "us-east-1"}},
+		{"s3://Not_A_Bucket", Options{"s3_region": "us-east-1"}},
+		{"s3://bucket", Options{}},
+	}
+
+	for _, test := range tests {
+		if _, err := newS3SourceFromURL(test.base, test.opts); err == nil {
+			t.Errorf("%s: expected an error", test.base)
+		}
+	}
+}
+
+func TestMFATokenProviderStaticCode(t *testing.T) {
+	provider := mfaTokenProvider(S3AssumeRoleOptions{
+		MFASerial:    "arn:aws:iam::123456789012:mfa/operator",
+		MFATokenCode: "123456",
+	})
+
+	if code, err := provider(); err != nil || code != "123456" {
+		t.Errorf("First code is '%s' (%v), expected '123456'", code, err)
+	}
+	if _, err := provider(); err == nil {
+		t.Errorf("Expected an error when the code is reused")
+	}
+}
+
+func TestMFATokenProviderTerminal(t *testing.T) {
+	saved := mfaTerminal
+	mfaTerminal = "/nonexistent/tty"
+	defer func() { mfaTerminal = saved }()
+
+	provider := mfaTokenProvider(S3AssumeRoleOptions{MFASerial: "arn:aws:iam::123456789012:mfa/operator"})
+	if _, err := provider(); err == nil {
+		t.Errorf("Expected an error without a terminal")
+	}
+}
+
+// vim: nolist expandtab ts=4 sw=4
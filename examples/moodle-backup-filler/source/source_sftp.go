@@ -0,0 +1,476 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func init() {
+	Register("sftp", newSFTPSourceFromURL)
+}
+
+// SFTPOptions configures an SFTPSource.
+type SFTPOptions struct {
+	// User and Host (with optional port, default 22) of the SSH server.
+	User string
+	Host string
+
+	// Path is the Moodle file directory on the server.
+	Path string
+
+	// KeyFile is the path of a private key to authenticate with.  Keys held
+	// by the SSH agent (SSH_AUTH_SOCK) are also tried.
+	KeyFile       string
+	KeyPassphrase string
+
+	// KnownHosts is the path of the known_hosts file used to verify the
+	// server's host key, defaulting to ~/.ssh/known_hosts.
+	KnownHosts string
+
+	// MaxSessions is the maximum number of SFTP sessions open at once over
+	// the SSH connection, defaulting to 4.
+	MaxSessions int
+}
+
+// SFTPSource implements the ContentSource interface for files stored on a
+// server reachable over SSH, using the standard Moodle data directory
+// layout.  A single SSH connection is shared by all files read, carrying up
+// to MaxSessions SFTP sessions so that files can be read concurrently, and
+// is re-established if it's lost.
+type SFTPSource struct {
+	opts   SFTPOptions
+	config *ssh.ClientConfig
+
+	// mu guards conn, which is nil until first used or after it's lost,
+	// and conns, the connection each session was opened on
+	mu    sync.Mutex
+	conn  *ssh.Client
+	conns map[*sftp.Client]*ssh.Client
+
+	// idle holds sessions not currently in use, and slots limits the
+	// number of sessions in use or idle to MaxSessions
+	idle  chan *sftp.Client
+	slots chan struct{}
+}
+
+// newSFTPSourceFromURL is the Factory for sftp://user@host/path content
+// bases.  The sftp_key_file, sftp_key_passphrase, sftp_known_hosts and
+// sftp_max_sessions options are optional.
+func newSFTPSourceFromURL(base string, opts Options) (ContentSource, error) {
+	contentURL, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("contentbase '%s' is not a valid URL: %v", base, err)
+	}
+	if contentURL.Host == "" {
+		return nil, fmt.Errorf("contentbase '%s' does not include a host name", base)
+	}
+
+	sftpOpts := SFTPOptions{
+		Host:          contentURL.Host,
+		Path:          contentURL.Path,
+		KeyFile:       opts["sftp_key_file"],
+		KeyPassphrase: opts["sftp_key_passphrase"],
+		KnownHosts:    opts["sftp_known_hosts"],
+	}
+	if contentURL.User != nil {
+		sftpOpts.User = contentURL.User.Username()
+	}
+	if maxSessions := opts["sftp_max_sessions"]; maxSessions != "" && maxSessions != "0" {
+		sftpOpts.MaxSessions, err = strconv.Atoi(maxSessions)
+		if err != nil || sftpOpts.MaxSessions < 1 {
+			return nil, fmt.Errorf("sftp_max_sessions '%s' must be a positive number", maxSessions)
+		}
+	}
+
+	return NewSFTPSource(sftpOpts)
+}
+
+// NewSFTPSource returns a ContentSource for files in the directory on the
+// server described by opts.  The key file and known_hosts file are read
+// immediately, but the server isn't connected to until it's first used.
+func NewSFTPSource(opts SFTPOptions) (*SFTPSource, error) {
+	if opts.User == "" {
+		if u := os.Getenv("USER"); u != "" {
+			opts.User = u
+		}
+	}
+	if _, _, err := net.SplitHostPort(opts.Host); err != nil {
+		opts.Host = net.JoinHostPort(opts.Host, "22")
+	}
+	if opts.MaxSessions <= 0 {
+		opts.MaxSessions = 4
+	}
+	if opts.KnownHosts == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return nil, fmt.Errorf("Unable to find known_hosts file without HOME, provide sftp_known_hosts")
+		}
+		opts.KnownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(opts.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read sftp_known_hosts '%s': %v", opts.KnownHosts, err)
+	}
+
+	auth := []ssh.AuthMethod{}
+	if opts.KeyFile != "" {
+		signer, err := readPrivateKey(opts.KeyFile, opts.KeyPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read sftp_key_file '%s': %v", opts.KeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		// the agent is dialled for each authentication attempt, so it
+		// needn't be running until we connect
+		auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			agentConn, err := net.Dial("unix", sock)
+			if err != nil {
+				return nil, err
+			}
+			defer agentConn.Close()
+			return agent.NewClient(agentConn).Signers()
+		}))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("No SSH credentials available for '%s', provide sftp_key_file or run an SSH agent", opts.Host)
+	}
+
+	return &SFTPSource{
+		opts: opts,
+		config: &ssh.ClientConfig{
+			User:            opts.User,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         30 * time.Second,
+		},
+		conns: map[*sftp.Client]*ssh.Client{},
+		idle:  make(chan *sftp.Client, opts.MaxSessions),
+		slots: make(chan struct{}, opts.MaxSessions),
+	}, nil
+}
+
+// readPrivateKey reads a private key from filename, decrypting it with
+// passphrase if it's not empty.
+func readPrivateKey(filename, passphrase string) (ssh.Signer, error) {
+	key, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+	}
+
+	return ssh.ParsePrivateKey(key)
+}
+
+// connect returns the SSH connection, establishing it if necessary.
+func (s *SFTPSource) connect() (*ssh.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		conn, err := ssh.Dial("tcp", s.opts.Host, s.config)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	}
+
+	return s.conn, nil
+}
+
+// disconnect closes conn if it's still the current SSH connection, so that
+// the next session is opened on a new connection.
+func (s *SFTPSource) disconnect(conn *ssh.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == conn {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// reset discards session, which failed, along with its SSH connection and
+// any idle sessions opened on that connection, since they'll have failed
+// too.  Sessions on a newer connection are kept.
+func (s *SFTPSource) reset(session *sftp.Client) {
+	s.mu.Lock()
+	conn := s.conns[session]
+	delete(s.conns, session)
+	s.mu.Unlock()
+	session.Close()
+	if conn == nil {
+		return
+	}
+	s.disconnect(conn)
+
+	var keep []*sftp.Client
+	for done := false; !done; {
+		select {
+		case idle := <-s.idle:
+			s.mu.Lock()
+			stale := s.conns[idle] == conn
+			if stale {
+				delete(s.conns, idle)
+			}
+			s.mu.Unlock()
+			if stale {
+				idle.Close()
+			} else {
+				keep = append(keep, idle)
+			}
+		default:
+			done = true
+		}
+	}
+	for _, idle := range keep {
+		s.park(idle)
+	}
+}
+
+// park adds session to the idle sessions, or closes it if there are already
+// MaxSessions idle (which can happen while reset is sorting through them).
+func (s *SFTPSource) park(session *sftp.Client) {
+	select {
+	case s.idle <- session:
+	default:
+		s.mu.Lock()
+		delete(s.conns, session)
+		s.mu.Unlock()
+		session.Close()
+	}
+}
+
+// acquire returns an SFTP session for exclusive use, reusing an idle session
+// if there is one, and waiting if MaxSessions are already in use.  The
+// session must be returned with release.
+func (s *SFTPSource) acquire(ctx context.Context) (*sftp.Client, error) {
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case session := <-s.idle:
+		return session, nil
+	default:
+	}
+
+	conn, err := s.connect()
+	if err != nil {
+		<-s.slots
+		return nil, fmt.Errorf("Unable to connect to '%s': %v", s.opts.Host, err)
+	}
+
+	session, err := sftp.NewClient(conn)
+	if err != nil {
+		// the connection is probably broken
+		s.disconnect(conn)
+		<-s.slots
+		return nil, fmt.Errorf("Unable to start SFTP session on '%s': %v", s.opts.Host, err)
+	}
+	s.mu.Lock()
+	s.conns[session] = conn
+	s.mu.Unlock()
+
+	return session, nil
+}
+
+// release returns a session acquired with acquire.  If err (the result of
+// using the session) suggests the session or connection failed, rather than
+// that a file couldn't be found, the session is discarded along with its
+// connection and the idle sessions on it, so that the next session is
+// opened on a new connection.
+func (s *SFTPSource) release(session *sftp.Client, err error) {
+	if err != nil && !os.IsNotExist(err) && !os.IsPermission(err) {
+		if _, ok := err.(*sftp.StatusError); !ok {
+			s.reset(session)
+			<-s.slots
+			return
+		}
+	}
+
+	s.park(session)
+	<-s.slots
+}
+
+// contentPath returns the path of the file with hash contentHash on the
+// server.
+func (s *SFTPSource) contentPath(contentHash string) string {
+	paddedHash := contentHash + "____" // ensure slices below don't fail if contentHash is invalid
+
+	return path.Join(s.opts.Path, paddedHash[:2], paddedHash[2:4], contentHash)
+}
+
+// Name returns "sftp".
+func (s *SFTPSource) Name() string {
+	return "sftp"
+}
+
+// Open returns a ContentReader for the file with hash contentHash.  The
+// session used to read the file is held until the reader is closed.
+func (s *SFTPSource) Open(ctx context.Context, contentHash string) (ContentReader, error) {
+	session, err := s.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := NewSFTPContentReader(session, s.contentPath(contentHash))
+	if err != nil {
+		s.release(session, err)
+		return nil, err
+	}
+	reader.release = s.release
+
+	return reader, nil
+}
+
+// Stat returns information about the file with hash contentHash.
+func (s *SFTPSource) Stat(ctx context.Context, contentHash string) (*FileInfo, error) {
+	session, err := s.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filePath := s.contentPath(contentHash)
+	fileInfo, err := session.Stat(filePath)
+	s.release(session, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileInfo{
+		Size:     fileInfo.Size(),
+		Location: fmt.Sprintf("sftp://%s@%s%s", s.opts.User, s.opts.Host, filePath),
+	}, nil
+}
+
+// Close closes idle sessions and the SSH connection.  Files still open are
+// left to fail.
+func (s *SFTPSource) Close() error {
+	for done := false; !done; {
+		select {
+		case session := <-s.idle:
+			session.Close()
+		default:
+			done = true
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conns = map[*sftp.Client]*ssh.Client{}
+
+	if s.conn != nil {
+		err := s.conn.Close()
+		s.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+// Validate confirms that the server can be reached, that it accepts our
+// credentials and host key, and that the Moodle file directory exists.
+func (s *SFTPSource) Validate(ctx context.Context) error {
+	session, err := s.acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	fileInfo, err := session.Stat(s.opts.Path)
+	s.release(session, err)
+	if err != nil {
+		return fmt.Errorf("Unable to read contentbase directory '%s' on '%s': %v", s.opts.Path, s.opts.Host, err)
+	}
+	if !fileInfo.IsDir() {
+		return fmt.Errorf("contentbase '%s' on '%s' is not a directory", s.opts.Path, s.opts.Host)
+	}
+
+	return nil
+}
+
+// SFTPContentReader implements the ContentReader interface for files read
+// over SFTP.
+type SFTPContentReader struct {
+	session *sftp.Client
+	file    *sftp.File
+	size    int64
+
+	// release is called with the session when the reader is closed
+	release func(*sftp.Client, error)
+	err     error
+}
+
+// NewSFTPContentReader returns a ContentReader which reads the file at
+// filePath using session.
+func NewSFTPContentReader(session *sftp.Client, filePath string) (*SFTPContentReader, error) {
+	file, err := session.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &SFTPContentReader{
+		session: session,
+		file:    file,
+		size:    fileInfo.Size(),
+	}, nil
+}
+
+// Size returns the size of the currently open file.
+func (cr *SFTPContentReader) Size() int64 {
+	return cr.size
+}
+
+// Read reads bytes from the currently open file.
+func (cr *SFTPContentReader) Read(b []byte) (int, error) {
+	n, err := cr.file.Read(b)
+	if err != nil && cr.err == nil {
+		cr.err = err
+	}
+
+	return n, err
+}
+
+// Close closes the currently open file and releases its session.
+func (cr *SFTPContentReader) Close() error {
+	err := cr.file.Close()
+	if cr.release != nil {
+		releaseErr := cr.err
+		if releaseErr == io.EOF {
+			releaseErr = nil
+		}
+		cr.release(cr.session, releaseErr)
+		cr.release = nil
+	}
+
+	return err
+}
+
+// vim: nolist expandtab ts=4 sw=4
@@ -0,0 +1,300 @@
+package source
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSFTPServer is an in-process SSH server with the sftp subsystem,
+// serving the local filesystem.
+type testSFTPServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	// mu guards conns, the connections accepted, and sessions, the
+	// number of SFTP sessions started
+	mu       sync.Mutex
+	conns    []*ssh.ServerConn
+	sessions int
+}
+
+// newTestSFTPServer starts an SSH server accepting the client key
+// clientKey, writing its host key to a known_hosts file in dir.
+func newTestSFTPServer(t *testing.T, dir string, clientKey ssh.PublicKey) *testSFTPServer {
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	knownHosts := knownhosts.Line([]string{listener.Addr().String()}, hostSigner.PublicKey()) + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "known_hosts"), []byte(knownHosts), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testSFTPServer{
+		listener: listener,
+		config: &ssh.ServerConfig{
+			PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				if string(key.Marshal()) != string(clientKey.Marshal()) {
+					return nil, io.EOF
+				}
+				return nil, nil
+			},
+		},
+	}
+	s.config.AddHostKey(hostSigner)
+	go s.serve()
+
+	return s
+}
+
+// serve accepts connections until the listener is closed.
+func (s *testSFTPServer) serve() {
+	for {
+		tcpConn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			conn, chans, reqs, err := ssh.NewServerConn(tcpConn, s.config)
+			if err != nil {
+				tcpConn.Close()
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go ssh.DiscardRequests(reqs)
+			for newChannel := range chans {
+				if newChannel.ChannelType() != "session" {
+					newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+					continue
+				}
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					continue
+				}
+				go s.serveSession(channel, requests)
+			}
+		}()
+	}
+}
+
+// serveSession starts an SFTP server on channel once it's requested.
+func (s *testSFTPServer) serveSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	for req := range requests {
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+
+		s.mu.Lock()
+		s.sessions++
+		s.mu.Unlock()
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			channel.Close()
+			return
+		}
+		go func() {
+			server.Serve()
+			server.Close()
+		}()
+	}
+}
+
+// counts returns the number of connections accepted and SFTP sessions
+// started.
+func (s *testSFTPServer) counts() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.conns), s.sessions
+}
+
+// drop closes every connection, as if the network failed.
+func (s *testSFTPServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *testSFTPServer) Close() {
+	s.listener.Close()
+	s.drop()
+}
+
+// newTestSFTPSource starts a testSFTPServer and returns an SFTPSource for a
+// file directory containing the file with hash contentHash.
+func newTestSFTPSource(t *testing.T, contentHash string, maxSessions int) (*SFTPSource, *testSFTPServer, func()) {
+	dir, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ecdsa")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	clientPub, err := ssh.NewPublicKey(&clientKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileDir := filepath.Join(dir, "filedir")
+	filePath := localContentPath(fileDir, LayoutMoodle, contentHash)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filePath, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := newTestSFTPServer(t, dir, clientPub)
+	src, err := NewSFTPSource(SFTPOptions{
+		User:        "moodle",
+		Host:        server.listener.Addr().String(),
+		Path:        fileDir,
+		KeyFile:     keyFile,
+		KnownHosts:  filepath.Join(dir, "known_hosts"),
+		MaxSessions: maxSessions,
+	})
+	if err != nil {
+		server.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return src, server, func() {
+		src.Close()
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSFTPSessionPool(t *testing.T) {
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	src, server, cleanup := newTestSFTPSource(t, hash, 2)
+	defer cleanup()
+	ctx := context.Background()
+
+	if err := src.Validate(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// sessions are reused, and files not found don't discard them
+	for i := 0; i < 3; i++ {
+		reader, err := src.Open(ctx, hash)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(data) != "content" {
+			t.Errorf("expected %q, got %q (%v)", "content", data, err)
+		}
+	}
+	if _, err := src.Stat(ctx, "ffffffffffffffffffffffffffffffffffffffff"); !IsNotFound(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+	if conns, sessions := server.counts(); conns != 1 || sessions != 1 {
+		t.Errorf("expected 1 connection and 1 session, got %d and %d", conns, sessions)
+	}
+
+	// no more than MaxSessions are open at once
+	first, err := src.Open(ctx, hash)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := src.Open(ctx, hash)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := src.Open(waitCtx, hash); err != context.DeadlineExceeded {
+		t.Errorf("expected to wait for a session, got %v", err)
+	}
+	first.Close()
+	second.Close()
+	if conns, sessions := server.counts(); conns != 1 || sessions != 2 {
+		t.Errorf("expected 1 connection and 2 sessions, got %d and %d", conns, sessions)
+	}
+	if len(src.idle) != 2 {
+		t.Errorf("expected 2 idle sessions, got %d", len(src.idle))
+	}
+}
+
+func TestSFTPSessionReset(t *testing.T) {
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	src, server, cleanup := newTestSFTPSource(t, hash, 2)
+	defer cleanup()
+	ctx := context.Background()
+
+	if _, err := src.Stat(ctx, hash); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(src.idle) != 1 {
+		t.Fatalf("expected 1 idle session, got %d", len(src.idle))
+	}
+
+	// the idle session fails once the connection is lost, and is
+	// discarded rather than returned to the pool
+	server.drop()
+	if _, err := src.Stat(ctx, hash); err == nil || IsNotFound(err) {
+		t.Fatalf("expected the lost connection to fail, got %v", err)
+	}
+	if len(src.idle) != 0 || len(src.conns) != 0 || src.conn != nil {
+		t.Errorf("expected broken session and connection to be discarded, got %d idle, %d sessions and connection %v", len(src.idle), len(src.conns), src.conn)
+	}
+
+	// so the next request reconnects
+	info, err := src.Stat(ctx, hash)
+	if err != nil || info.Size != int64(len("content")) {
+		t.Fatalf("expected to reconnect, got %+v (%v)", info, err)
+	}
+	if conns, sessions := server.counts(); conns != 2 || sessions != 2 {
+		t.Errorf("expected 2 connections and 2 sessions, got %d and %d", conns, sessions)
+	}
+	if len(src.idle) != 1 || len(src.conns) != 1 {
+		t.Errorf("expected 1 idle session, got %d idle and %d sessions", len(src.idle), len(src.conns))
+	}
+}
+
+// vim: nolist expandtab ts=4 sw=4
@@ -0,0 +1,373 @@
+package source
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"moodle-backup-filler/logger"
+)
+
+func init() {
+	Register("tar", newTarSourceFromURL)
+}
+
+// hashPattern matches the base name of a file in a Moodle file store.
+var hashPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// TarOptions configures a TarSource.
+type TarOptions struct {
+	// Path is the tarball containing the file store, in any layout, e.g.
+	// filedir.tar or filedir.tar.gz.  Files are recognised by their names
+	// being content hashes.
+	Path string
+
+	// IndexFile is where the offset of each file in an uncompressed
+	// tarball is saved, defaulting to Path with .index.json appended.
+	IndexFile string
+
+	// ExtractDir is where the files in a compressed tarball are extracted
+	// to, defaulting to Path with .files appended.
+	ExtractDir string
+}
+
+// TarSource implements the ContentSource interface for files in a tarball
+// of a Moodle file store.
+//
+// Files in an uncompressed tarball are read in place, using an index of
+// their offsets built the first time the tarball is used.  Compressed
+// tarballs can't be read at an offset, so the first time one is used its
+// files are extracted (in the standard Moodle layout) and then read from
+// there.
+type TarSource struct {
+	opts TarOptions
+
+	// file and index are used for an uncompressed tarball
+	file  *os.File
+	index *tarIndex
+
+	// local is used for a compressed tarball, once extracted
+	local *LocalSource
+}
+
+// tarIndex is the saved index of an uncompressed tarball.  Size and ModTime
+// identify the version of the tarball indexed.
+type tarIndex struct {
+	Size    int64                    `json:"size"`
+	ModTime time.Time                `json:"modtime"`
+	Entries map[string]*tarIndexItem `json:"entries"`
+}
+
+// tarIndexItem locates a file's data within an uncompressed tarball.
+type tarIndexItem struct {
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+// newTarSourceFromURL is the Factory for tar:///path/to/filedir.tar content
+// bases.  The tar_index_file and tar_extract_dir options are optional.
+func newTarSourceFromURL(base string, opts Options) (ContentSource, error) {
+	return NewTarSource(TarOptions{
+		Path:       strings.TrimPrefix(base, "tar://"),
+		IndexFile:  opts["tar_index_file"],
+		ExtractDir: opts["tar_extract_dir"],
+	})
+}
+
+// NewTarSource returns a ContentSource for the files in the tarball
+// described by opts, indexing or extracting it if that hasn't already been
+// done for this version of the tarball.
+func NewTarSource(opts TarOptions) (*TarSource, error) {
+	if opts.Path == "" {
+		return nil, fmt.Errorf("No tarball provided for tar content source")
+	}
+	if opts.IndexFile == "" {
+		opts.IndexFile = opts.Path + ".index.json"
+	}
+	if opts.ExtractDir == "" {
+		opts.ExtractDir = opts.Path + ".files"
+	}
+
+	file, err := os.Open(opts.Path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open tarball: %v", err)
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	s := &TarSource{opts: opts}
+
+	decompressor, err := newDecompressor(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to read tarball '%s': %v", opts.Path, err)
+	}
+	if decompressor != nil {
+		defer file.Close()
+		if err := s.extract(decompressor, fileInfo); err != nil {
+			return nil, err
+		}
+		s.local = NewLocalSource(opts.ExtractDir)
+		return s, nil
+	}
+
+	s.file = file
+	if err := s.loadIndex(fileInfo); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// newDecompressor returns a reader which decompresses file if it's gzip or
+// bzip2 compressed, or nil if it's not compressed.  file is left positioned
+// at the start.
+func newDecompressor(file *os.File) (io.Reader, error) {
+	magic := make([]byte, 3)
+	n, err := io.ReadFull(file, magic)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case n >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		return gzip.NewReader(bufio.NewReader(file))
+	case n >= 3 && string(magic) == "BZh":
+		return bzip2.NewReader(bufio.NewReader(file)), nil
+	}
+
+	return nil, nil
+}
+
+// loadIndex loads the saved index of the uncompressed tarball, rebuilding
+// it if there isn't one for this version of the tarball.
+func (s *TarSource) loadIndex(fileInfo os.FileInfo) error {
+	if data, err := ioutil.ReadFile(s.opts.IndexFile); err == nil {
+		index := &tarIndex{}
+		if err := json.Unmarshal(data, index); err != nil {
+			logger.Err.WithError(err).Warnf("Unable to load index '%s', rebuilding it", s.opts.IndexFile)
+		} else if index.Size == fileInfo.Size() && index.ModTime.Equal(fileInfo.ModTime()) {
+			s.index = index
+			return nil
+		}
+	}
+
+	start := time.Now()
+	index := &tarIndex{
+		Size:    fileInfo.Size(),
+		ModTime: fileInfo.ModTime(),
+		Entries: map[string]*tarIndexItem{},
+	}
+
+	counter := &offsetReader{reader: bufio.NewReaderSize(s.file, 1<<20)}
+	tr := tar.NewReader(counter)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to index tarball '%s': %v", s.opts.Path, err)
+		}
+
+		// the file itself is read ahead by the buffer, but the data
+		// starts where the tar reader has read up to
+		if isContentFile(header) {
+			index.Entries[path.Base(header.Name)] = &tarIndexItem{
+				Offset: counter.offset,
+				Size:   header.Size,
+			}
+		}
+	}
+	s.index = index
+	logger.Err.WithField("duration", time.Since(start).Seconds()).Infof("Indexed %d files in tarball '%s'", len(index.Entries), s.opts.Path)
+
+	if err := writeFileAtomic(s.opts.IndexFile, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(index)
+	}); err != nil {
+		logger.Err.WithError(err).Warnf("Unable to save index '%s', tarball will be indexed again next time", s.opts.IndexFile)
+	}
+
+	return nil
+}
+
+// extract extracts the files in the compressed tarball to ExtractDir, unless
+// that has already been done for this version of the tarball.  A marker
+// file recording the version is written once extraction has completed.
+func (s *TarSource) extract(decompressor io.Reader, fileInfo os.FileInfo) error {
+	marker := filepath.Join(s.opts.ExtractDir, ".extracted.json")
+	version := &tarIndex{
+		Size:    fileInfo.Size(),
+		ModTime: fileInfo.ModTime(),
+	}
+
+	if data, err := ioutil.ReadFile(marker); err == nil {
+		extracted := &tarIndex{}
+		if err := json.Unmarshal(data, extracted); err == nil && extracted.Size == version.Size && extracted.ModTime.Equal(version.ModTime) {
+			return nil
+		}
+	}
+
+	start := time.Now()
+	logger.Err.Infof("Extracting tarball '%s' to '%s', this is only done once", s.opts.Path, s.opts.ExtractDir)
+	if err := os.MkdirAll(s.opts.ExtractDir, 0755); err != nil {
+		return fmt.Errorf("Unable to create tar_extract_dir '%s': %v", s.opts.ExtractDir, err)
+	}
+
+	count := 0
+	tr := tar.NewReader(decompressor)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to extract tarball '%s': %v", s.opts.Path, err)
+		}
+		if !isContentFile(header) {
+			continue
+		}
+
+		contentHash := path.Base(header.Name)
+		filePath := localContentPath(s.opts.ExtractDir, LayoutMoodle, contentHash)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return fmt.Errorf("Unable to extract tarball '%s': %v", s.opts.Path, err)
+		}
+		if err := writeFileAtomic(filePath, func(w io.Writer) error {
+			_, err := io.Copy(w, tr)
+			return err
+		}); err != nil {
+			return fmt.Errorf("Unable to extract '%s' from tarball '%s': %v", header.Name, s.opts.Path, err)
+		}
+		count++
+	}
+
+	if err := writeFileAtomic(marker, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(version)
+	}); err != nil {
+		logger.Err.WithError(err).Warnf("Unable to save '%s', tarball will be extracted again next time", marker)
+	}
+	logger.Err.WithField("duration", time.Since(start).Seconds()).Infof("Extracted %d files from tarball '%s'", count, s.opts.Path)
+
+	return nil
+}
+
+// isContentFile returns true if header is for a file in the file store,
+// i.e. a regular file named by its content hash.
+func isContentFile(header *tar.Header) bool {
+	return (header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA) && hashPattern.MatchString(path.Base(header.Name))
+}
+
+// writeFileAtomic writes filename using write, replacing any existing file
+// only once it has been written successfully.
+func writeFileAtomic(filename string, write func(io.Writer) error) error {
+	file, err := ioutil.TempFile(filepath.Dir(filename), ".tmp-"+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) // no-op once renamed
+
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), filename)
+}
+
+// offsetReader counts the bytes read from reader.
+type offsetReader struct {
+	reader io.Reader
+	offset int64
+}
+
+// Read reads bytes from the underlying reader, counting them.
+func (r *offsetReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.offset += int64(n)
+
+	return n, err
+}
+
+// Name returns "tar".
+func (s *TarSource) Name() string {
+	return "tar"
+}
+
+// Open returns a ContentReader for the file with hash contentHash.
+func (s *TarSource) Open(ctx context.Context, contentHash string) (ContentReader, error) {
+	if s.local != nil {
+		return s.local.Open(ctx, contentHash)
+	}
+
+	item, ok := s.index.Entries[contentHash]
+	if !ok {
+		return nil, &NotFoundError{Message: fmt.Sprintf("File '%s' is not in tarball '%s'", contentHash, s.opts.Path)}
+	}
+
+	return &TarContentReader{
+		SectionReader: io.NewSectionReader(s.file, item.Offset, item.Size),
+	}, nil
+}
+
+// Stat returns information about the file with hash contentHash.
+func (s *TarSource) Stat(ctx context.Context, contentHash string) (*FileInfo, error) {
+	if s.local != nil {
+		return s.local.Stat(ctx, contentHash)
+	}
+
+	item, ok := s.index.Entries[contentHash]
+	if !ok {
+		return nil, &NotFoundError{Message: fmt.Sprintf("File '%s' is not in tarball '%s'", contentHash, s.opts.Path)}
+	}
+
+	return &FileInfo{
+		Size:     item.Size,
+		Location: fmt.Sprintf("%s@%d", s.opts.Path, item.Offset),
+	}, nil
+}
+
+// Close closes the tarball.
+func (s *TarSource) Close() error {
+	if s.file != nil {
+		return s.file.Close()
+	}
+
+	return nil
+}
+
+// TarContentReader implements the ContentReader interface for a file in an
+// uncompressed tarball.  Files are read with ReadAt, so any number can be
+// read at once.
+type TarContentReader struct {
+	*io.SectionReader
+}
+
+// Close does nothing, since the tarball is closed by its TarSource.
+func (cr *TarContentReader) Close() error {
+	return nil
+}
+
+// vim: nolist expandtab ts=4 sw=4
@@ -0,0 +1,210 @@
+package source
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tarTestFiles returns the content of some files for a file store, keyed by
+// their content hashes.  Their sizes aren't multiples of the tar block size,
+// so each file's data is followed by padding.
+func tarTestFiles(variant string) map[string]string {
+	files := map[string]string{}
+	for _, content := range []string{
+		"",
+		"hello " + variant,
+		strings.Repeat("0123456789", 100) + variant,
+		strings.Repeat("x", 3000) + variant,
+	} {
+		files[fmt.Sprintf("%x", sha1.Sum([]byte(content)))] = content
+	}
+
+	return files
+}
+
+// writeTestTarball writes files to filename as a tarball of a Moodle
+// filedir, with some other entries that aren't content files, gzipped if
+// compress is true, and with the modification time modTime.
+func writeTestTarball(t *testing.T, filename string, files map[string]string, compress bool, modTime time.Time) {
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out io.Writer = file
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(file)
+		out = gz
+	}
+	tw := tar.NewWriter(out)
+
+	write := func(header *tar.Header, content string) {
+		header.Size = int64(len(content))
+		header.Mode = 0644
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(&tar.Header{Name: "filedir/", Typeflag: tar.TypeDir}, "")
+	write(&tar.Header{Name: "filedir/warning.txt", Typeflag: tar.TypeReg}, "Do not delete")
+	for contentHash, content := range files {
+		write(&tar.Header{Name: "filedir/" + contentHash[:2] + "/" + contentHash[2:4] + "/" + contentHash, Typeflag: tar.TypeReg}, content)
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkTarSource confirms that every file in files can be read from src,
+// and that a file that isn't there isn't found.
+func checkTarSource(t *testing.T, src *TarSource, files map[string]string) {
+	ctx := context.Background()
+	for contentHash, content := range files {
+		reader, err := src.Open(ctx, contentHash)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", contentHash, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error reading: %v", contentHash, err)
+		} else if string(data) != content {
+			t.Errorf("%s: expected %d bytes %.20q..., got %d bytes %.20q...", contentHash, len(content), content, len(data), data)
+		}
+		if reader.Size() != int64(len(content)) {
+			t.Errorf("%s: expected size %d, got %d", contentHash, len(content), reader.Size())
+		}
+
+		info, err := src.Stat(ctx, contentHash)
+		if err != nil || info.Size != int64(len(content)) {
+			t.Errorf("%s: expected size %d, got %+v (%v)", contentHash, len(content), info, err)
+		}
+	}
+
+	missing := strings.Repeat("f", 40)
+	if _, err := src.Open(ctx, missing); !IsNotFound(err) {
+		t.Errorf("expected *NotFoundError for missing file, got %v", err)
+	}
+	if _, err := src.Stat(ctx, missing); !IsNotFound(err) {
+		t.Errorf("expected *NotFoundError for missing file, got %v", err)
+	}
+}
+
+func TestTarSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "filedir.tar")
+	modTime := time.Now().Add(-time.Hour)
+	files := tarTestFiles("one")
+	writeTestTarball(t, filename, files, false, modTime)
+
+	src, err := NewTarSource(TarOptions{Path: filename})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkTarSource(t, src, files)
+	src.Close()
+	if _, err := os.Stat(filename + ".index.json"); err != nil {
+		t.Errorf("expected index to be saved: %v", err)
+	}
+
+	// the saved index is used
+	src, err = NewTarSource(TarOptions{Path: filename})
+	if err != nil {
+		t.Fatalf("unexpected error reopening: %v", err)
+	}
+	checkTarSource(t, src, files)
+	src.Close()
+
+	// and rebuilt once the tarball changes
+	files = tarTestFiles("two")
+	writeTestTarball(t, filename, files, false, modTime.Add(time.Minute))
+	src, err = NewTarSource(TarOptions{Path: filename})
+	if err != nil {
+		t.Fatalf("unexpected error reopening: %v", err)
+	}
+	checkTarSource(t, src, files)
+	src.Close()
+}
+
+func TestTarSourceCompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "filedir.tar.gz")
+	extractDir := filepath.Join(dir, "extracted")
+	modTime := time.Now().Add(-time.Hour)
+	files := tarTestFiles("one")
+	writeTestTarball(t, filename, files, true, modTime)
+
+	src, err := NewTarSource(TarOptions{Path: filename, ExtractDir: extractDir})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkTarSource(t, src, files)
+	src.Close()
+
+	// the files are only extracted once, so one removed since is gone
+	var removed string
+	for contentHash := range files {
+		removed = contentHash
+		break
+	}
+	if err := os.Remove(localContentPath(extractDir, LayoutMoodle, removed)); err != nil {
+		t.Fatal(err)
+	}
+	src, err = NewTarSource(TarOptions{Path: filename, ExtractDir: extractDir})
+	if err != nil {
+		t.Fatalf("unexpected error reopening: %v", err)
+	}
+	if _, err := src.Open(context.Background(), removed); !IsNotFound(err) {
+		t.Errorf("expected tarball not to be extracted again, got %v", err)
+	}
+	src.Close()
+
+	// unless the tarball changes
+	files = tarTestFiles("two")
+	writeTestTarball(t, filename, files, true, modTime.Add(time.Minute))
+	src, err = NewTarSource(TarOptions{Path: filename, ExtractDir: extractDir})
+	if err != nil {
+		t.Fatalf("unexpected error reopening: %v", err)
+	}
+	checkTarSource(t, src, files)
+	src.Close()
+}
+
+// vim: nolist expandtab ts=4 sw=4
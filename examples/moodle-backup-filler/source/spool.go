@@ -0,0 +1,52 @@
+package source
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// spool reads the whole of reader, whose length isn't known in advance, and
+// returns a copy of it and its size.  Up to memoryLimit bytes are held in
+// memory, and anything larger is written to a temporary file in dir (the
+// system temporary directory if empty), up to maxSize bytes (0 for no
+// limit).  maxSizeOption names the option setting maxSize, for the error
+// returned if it's exceeded.
+func spool(reader io.Reader, memoryLimit, maxSize int64, dir, maxSizeOption string) (io.ReadCloser, int64, error) {
+	buf := &bytes.Buffer{}
+	n, err := io.CopyN(buf, reader, memoryLimit+1)
+	if err == io.EOF {
+		return ioutil.NopCloser(buf), n, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	file, err := ioutil.TempFile(dir, "moodle-backup-filler-spool")
+	if err != nil {
+		return nil, 0, fmt.Errorf("Unable to spool file of unknown length: %v", err)
+	}
+	os.Remove(file.Name()) // removed once closed
+
+	rest := reader
+	if maxSize > 0 {
+		rest = io.LimitReader(reader, maxSize-n+1)
+	}
+	size, err := io.Copy(file, io.MultiReader(buf, rest))
+	if err == nil && maxSize > 0 && size > maxSize {
+		err = fmt.Errorf("File of unknown length is larger than %s (%d bytes)", maxSizeOption, maxSize)
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	return file, size, nil
+}
+
+// vim: nolist expandtab ts=4 sw=4
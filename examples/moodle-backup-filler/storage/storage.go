@@ -0,0 +1,152 @@
+// Package storage provides access to Moodle course backup files, which may
+// be on local disk or in an S3 bucket, or streamed through stdin and stdout.
+// Locations are either local paths, URLs of the form s3://bucket/key, or "-"
+// for stdin/stdout.
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Writer implements the io.WriteCloser interface for a single backup file.
+// The file is only complete once Close returns without error.
+type Writer interface {
+	// Abort discards the file being written.
+	Abort() error
+
+	io.WriteCloser
+}
+
+// Info describes a backup file.
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Store provides access to backup files, using an S3Client for those in S3.
+type Store struct {
+	s3 *S3Client
+}
+
+// New returns a Store which uses s3 for backup files in S3.  s3 may be nil
+// if no locations are in S3.
+func New(s3 *S3Client) *Store {
+	return &Store{s3: s3}
+}
+
+// IsS3 reports whether location refers to an S3 bucket.
+func IsS3(location string) bool {
+	return strings.HasPrefix(location, "s3://")
+}
+
+// SplitS3URL splits an s3://bucket/key URL into bucket and key (or key
+// prefix), either of which may be empty.
+func SplitS3URL(url string) (bucket, key string) {
+	parts := strings.SplitN(strings.TrimPrefix(url, "s3://"), "/", 2)
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	return parts[0], key
+}
+
+// Open returns a reader for the backup file at location.
+func (st *Store) Open(location string) (io.ReadCloser, error) {
+	if location == Stdio {
+		return openStdin()
+	}
+	if IsS3(location) {
+		return st.openS3(location)
+	}
+
+	return openLocal(location)
+}
+
+// Create returns a Writer for a new backup file at location, replacing any
+// existing file.
+func (st *Store) Create(location string) (Writer, error) {
+	if location == Stdio {
+		return createStdout()
+	}
+	if IsS3(location) {
+		return st.createS3(location)
+	}
+
+	return createLocal(location)
+}
+
+// Exists reports whether there's already a backup file at location.
+func (st *Store) Exists(location string) (bool, error) {
+	if location == Stdio {
+		return false, nil
+	}
+	if IsS3(location) {
+		return st.existsS3(location)
+	}
+
+	return existsLocal(location)
+}
+
+// Stat returns the size and modification time of the backup at location.
+// For an extracted backup in a local directory, they're the total size of
+// the files in it and the newest modification time of anything in it, so
+// that a change anywhere in the backup is noticed.
+func (st *Store) Stat(location string) (*Info, error) {
+	if location == Stdio {
+		return nil, fmt.Errorf("Standard input has no size or modification time")
+	}
+	if IsS3(location) {
+		return st.statS3(location)
+	}
+
+	return statLocal(location)
+}
+
+// List returns the names of the files in the directory (or S3 prefix) dir.
+// Names are relative to dir and can be appended using Join.
+func (st *Store) List(dir string) ([]string, error) {
+	if IsS3(dir) {
+		return st.listS3(dir)
+	}
+
+	return listLocal(dir)
+}
+
+// ListAll returns the names of the files in the directory (or S3 prefix) dir
+// and all of its subdirectories.  Names are relative to dir, use "/" as the
+// separator, and can be appended using Join.
+func (st *Store) ListAll(dir string) ([]string, error) {
+	if IsS3(dir) {
+		return st.listAllS3(dir)
+	}
+
+	return listAllLocal(dir)
+}
+
+// MakeParent creates the directory that will contain location, and any of
+// its parents, if location is on local disk.  S3 has no directories to
+// create.
+func MakeParent(location string) error {
+	if location == Stdio || IsS3(location) {
+		return nil
+	}
+
+	return os.MkdirAll(filepath.Dir(location), 0755)
+}
+
+// Join appends name to the directory (or S3 prefix) dir.
+func Join(dir, name string) string {
+	if IsS3(dir) {
+		return "s3://" + path.Join(dir[5:], name)
+	}
+
+	return filepath.Join(dir, name)
+}
+
+// vim: nolist expandtab ts=4 sw=4
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// localWriter implements the Writer interface for files on local disk.
+type localWriter struct {
+	*os.File
+}
+
+func openLocal(filename string) (io.ReadCloser, error) {
+	return os.Open(filename)
+}
+
+func createLocal(filename string) (Writer, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &localWriter{file}, nil
+}
+
+// Abort closes and removes the file being written.
+func (w *localWriter) Abort() error {
+	w.File.Close()
+
+	return os.Remove(w.File.Name())
+}
+
+func existsLocal(filename string) (bool, error) {
+	_, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func statLocal(filename string) (*Info, error) {
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !fileInfo.IsDir() {
+		return &Info{Size: fileInfo.Size(), ModTime: fileInfo.ModTime()}, nil
+	}
+
+	info := &Info{}
+	err = filepath.Walk(filename, func(filename string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileInfo.Mode().IsRegular() {
+			info.Size += fileInfo.Size()
+		}
+		// directories are included, as removing a file changes the
+		// modification time of its directory
+		if fileInfo.ModTime().After(info.ModTime) {
+			info.ModTime = fileInfo.ModTime()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func listLocal(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		if file.Mode().IsRegular() {
+			names = append(names, file.Name())
+		}
+	}
+
+	return names, nil
+}
+
+func listAllLocal(dir string) ([]string, error) {
+	names := []string{}
+	err := filepath.Walk(dir, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		name, err := filepath.Rel(dir, filename)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(name))
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// vim: nolist expandtab ts=4 sw=4
@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	// AWS
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Options configures an S3Client.
+type S3Options struct {
+	// Region is the name of the region in which the bucket exists.
+	Region string
+
+	// Profile is the name of a profile in the shared AWS credentials file.
+	// If empty, credentials come from the environment or EC2 instance
+	// role.
+	Profile string
+
+	// AssumeRoleARN, if set, is the ARN of a role that provides read and
+	// write access to the bucket.
+	AssumeRoleARN string
+
+	// PartSize is the size in bytes of each part of a multipart upload,
+	// which limits the size of a backup to 10,000 parts.
+	PartSize int64
+
+	// HTTPClient makes requests to S3.  Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// S3Client provides a persistent S3 session for reading and writing backup
+// files.  It's configured independently of the S3 session used to read
+// Moodle content, since backups are typically written to a bucket owned by
+// the client rather than Open LMS.
+type S3Client struct {
+	session  *session.Session
+	s3Client *s3.S3
+	uploader *s3manager.Uploader
+}
+
+// NewS3Client returns an S3Client configured by opts.
+func NewS3Client(opts S3Options) (*S3Client, error) {
+	c := &S3Client{}
+
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	var creds *credentials.Credentials
+	if opts.Profile != "" {
+		creds = credentials.NewSharedCredentials("", opts.Profile)
+	} else {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvProvider{},
+			&ec2rolecreds.EC2RoleProvider{Client: ec2metadata.New(session.New())},
+		})
+	}
+
+	if _, err := creds.Get(); err != nil {
+		return nil, err
+	}
+
+	session, err := session.NewSession(&aws.Config{
+		Credentials: creds,
+		HTTPClient:  httpClient,
+		Region:      aws.String(opts.Region),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.AssumeRoleARN != "" {
+		stsCreds := stscreds.NewCredentials(session, opts.AssumeRoleARN)
+		session = session.Copy(&aws.Config{Credentials: stsCreds})
+	}
+	c.session = session
+
+	c.s3Client = s3.New(c.session)
+	c.uploader = s3manager.NewUploader(c.session, func(u *s3manager.Uploader) {
+		// large backups are streamed, so the part size determines the
+		// maximum size of a backup (PartSize * MaxUploadParts)
+		if opts.PartSize > 0 {
+			u.PartSize = opts.PartSize
+		}
+	})
+
+	return c, nil
+}
+
+// s3Client returns the S3Client used for url.
+func (st *Store) s3Client(url string) (*S3Client, error) {
+	if st.s3 == nil {
+		return nil, fmt.Errorf("No S3 client configured for '%s'", url)
+	}
+
+	return st.s3, nil
+}
+
+// parseS3URL splits an s3://bucket/key URL into bucket and key.
+func parseS3URL(url string) (bucket, key string, err error) {
+	bucket, key = SplitS3URL(url)
+	if bucket == "" {
+		return "", "", fmt.Errorf("'%s' does not include a bucket name", url)
+	}
+
+	return bucket, key, nil
+}
+
+func (st *Store) openS3(url string) (io.ReadCloser, error) {
+	c, err := st.s3Client(url)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket, key, err := parseS3URL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Body, nil
+}
+
+// s3Writer implements the Writer interface for files written to S3.  The
+// file is streamed to S3 as a multipart upload through a pipe.
+type s3Writer struct {
+	pipe *io.PipeWriter
+	done chan error
+}
+
+func (st *Store) createS3(url string) (Writer, error) {
+	c, err := st.s3Client(url)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket, key, err := parseS3URL(url)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" || strings.HasSuffix(key, "/") {
+		return nil, fmt.Errorf("'%s' does not include a file name", url)
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	w := &s3Writer{
+		pipe: pipeWriter,
+		done: make(chan error, 1),
+	}
+
+	go func() {
+		_, err := c.uploader.Upload(&s3manager.UploadInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Body:   pipeReader,
+		})
+		// unblock any writer if the upload failed part way through
+		pipeReader.CloseWithError(err)
+		w.done <- err
+	}()
+
+	return w, nil
+}
+
+// Write writes bytes to the upload.
+func (w *s3Writer) Write(b []byte) (int, error) {
+	return w.pipe.Write(b)
+}
+
+// Close completes the upload, returning any error encountered while
+// uploading.
+func (w *s3Writer) Close() error {
+	w.pipe.Close()
+
+	return <-w.done
+}
+
+// Abort cancels the upload, discarding any parts already uploaded.
+func (w *s3Writer) Abort() error {
+	w.pipe.CloseWithError(fmt.Errorf("Upload aborted"))
+	<-w.done
+
+	return nil
+}
+
+func (st *Store) existsS3(url string) (bool, error) {
+	c, err := st.s3Client(url)
+	if err != nil {
+		return false, err
+	}
+
+	bucket, key, err := parseS3URL(url)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = c.s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (st *Store) statS3(url string) (*Info, error) {
+	c, err := st.s3Client(url)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket, key, err := parseS3URL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Info{
+		Size:    aws.Int64Value(response.ContentLength),
+		ModTime: aws.TimeValue(response.LastModified),
+	}, nil
+}
+
+func (st *Store) listS3(url string) ([]string, error) {
+	return st.listS3Prefix(url, "/")
+}
+
+func (st *Store) listAllS3(url string) ([]string, error) {
+	return st.listS3Prefix(url, "")
+}
+
+// listS3Prefix lists the objects under the prefix in url, only including
+// those in "subdirectories" if delimiter is empty.
+func (st *Store) listS3Prefix(url, delimiter string) ([]string, error) {
+	c, err := st.s3Client(url)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket, prefix, err := parseS3URL(url)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+
+	names := []string{}
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	if delimiter != "" {
+		input.Delimiter = aws.String(delimiter)
+	}
+	err = c.s3Client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			name := strings.TrimPrefix(aws.StringValue(object.Key), prefix)
+			if name != "" && !strings.HasSuffix(name, "/") {
+				names = append(names, name)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// vim: nolist expandtab ts=4 sw=4
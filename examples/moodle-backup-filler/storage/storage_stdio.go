@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Stdio is the location used for reading a backup from stdin or writing a
+// backup to stdout.
+const Stdio = "-"
+
+// stdoutWriter implements the Writer interface for stdout.
+type stdoutWriter struct {
+	io.Writer
+}
+
+func openStdin() (io.ReadCloser, error) {
+	return ioutil.NopCloser(os.Stdin), nil
+}
+
+func createStdout() (Writer, error) {
+	return &stdoutWriter{os.Stdout}, nil
+}
+
+// Close does nothing since stdout remains open for the life of the process.
+func (w *stdoutWriter) Close() error {
+	return nil
+}
+
+// Abort does nothing since anything already written to stdout can't be
+// taken back.  Whatever is reading from stdout will find a truncated
+// backup.
+func (w *stdoutWriter) Abort() error {
+	return nil
+}
+
+// vim: nolist expandtab ts=4 sw=4
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify" // inotify and friends
+
+	"moodle-backup-filler/config"
+	"moodle-backup-filler/filler"
+	"moodle-backup-filler/journal"
+	"moodle-backup-filler/logger"
+	"moodle-backup-filler/moodle"
+	"moodle-backup-filler/source"
+	"moodle-backup-filler/storage"
+)
+
+// watchedFile tracks a file in the source directory until it's been
+// hydrated.
+type watchedFile struct {
+	size       int64
+	modTime    time.Time
+	lastChange time.Time
+
+	// done is set once the file has been hydrated (or hydration failed),
+	// so it's left alone until it changes
+	done bool
+
+	// retryAt is when to try again to hydrate a file that was deferred
+	// because files it needs weren't available yet
+	retryAt time.Time
+}
+
+// deferredRetryInterval is how long to wait before retrying a deferred
+// backup.
+const deferredRetryInterval = 10 * time.Minute
+
+// watch runs until interrupted, hydrating each backup that appears in the
+// source directory into the destination directory using f, recording each
+// in the journal j.
+//
+// Filesystem notifications are used where available to detect new and
+// changing files, and the source directory is also rescanned every
+// WatchInterval seconds to catch anything the notifications missed (or
+// everything, if notifications aren't available).  Every directory in the
+// source directory is watched, so that changes to files in subdirectories
+// and extracted backups are noticed too.  A file is only considered fully
+// written once neither its size nor modification time have changed for
+// WatchSettleTime seconds; for an extracted backup, that's the total size
+// and newest modification time of everything in it.
+func watch(f *filler.Filler, j *journal.Journal) {
+	interval := time.Duration(config.Config.WatchInterval) * time.Second
+	settle := time.Duration(config.Config.WatchSettleTime) * time.Second
+
+	// A nil channel blocks forever in a select, so if filesystem
+	// notifications are unavailable we're left with polling.
+	var events chan fsnotify.Event
+	var watchErrors chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Err.WithError(err).Warn("Filesystem notifications unavailable, falling back to polling")
+	} else if err := watchDirs(watcher, config.Config.SourceBackupDir); err != nil {
+		logger.Err.WithError(err).Warn("Unable to watch source directory, falling back to polling")
+		watcher.Close()
+	} else {
+		defer watcher.Close()
+		events = watcher.Events
+		watchErrors = watcher.Errors
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	logger.Err.Infof("Watching %s for new backups", config.Config.SourceBackupDir)
+
+	files := map[string]*watchedFile{}
+	scanSourceDir(f, j, files, settle)
+
+	for {
+		select {
+		case event := <-events:
+			name, ok := watchName(event.Name)
+			if !ok {
+				continue
+			}
+			logger.Err.Debugf("Watch: %s %s", event.Op, name)
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					// new directories aren't watched automatically
+					if err := watchDirs(watcher, event.Name); err != nil {
+						logger.Err.WithError(err).Warnf("Unable to watch %s", event.Name)
+					}
+				}
+			}
+			if file, ok := files[watchedKey(files, name)]; ok {
+				// still being written, postpone hydration
+				file.lastChange = time.Now()
+			}
+		case err := <-watchErrors:
+			logger.Err.WithError(err).Warn("Filesystem notification error")
+		case <-ticker.C:
+			scanSourceDir(f, j, files, settle)
+		case sig := <-signals:
+			logger.Err.Infof("Received %s, exiting", sig)
+			return
+		}
+	}
+}
+
+// watchDirs adds watches for dir and every directory in it that isn't
+// hidden, as notifications only cover the directories watched.  An error is
+// returned if dir can't be watched; directories in it that can't be are
+// left to rescanning.
+func watchDirs(watcher *fsnotify.Watcher, dir string) error {
+	if err := watcher.Add(dir); err != nil {
+		return err
+	}
+
+	return filepath.Walk(dir, func(filename string, info os.FileInfo, err error) error {
+		if filename == dir || err != nil || !info.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(filename); err != nil {
+			logger.Err.WithError(err).Warnf("Unable to watch %s", filename)
+		}
+
+		return nil
+	})
+}
+
+// watchName returns the name relative to the source directory of a file
+// named in a filesystem notification, or false if it's hidden or in a
+// hidden directory.
+func watchName(filename string) (string, bool) {
+	name, err := filepath.Rel(config.Config.SourceBackupDir, filename)
+	if err != nil || name == "." {
+		return "", false
+	}
+	name = filepath.ToSlash(name)
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", false
+		}
+	}
+
+	return name, true
+}
+
+// watchedKey returns the key in files of the backup that name, relative to
+// the source directory, belongs to: name itself, or for a file (or
+// directory) in an extracted backup, the backup's name ending in "/".  It
+// returns "" if name isn't part of a backup being watched.
+func watchedKey(files map[string]*watchedFile, name string) string {
+	if _, ok := files[name]; ok {
+		return name
+	}
+	if _, ok := files[name+"/"]; ok {
+		return name + "/"
+	}
+
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		dir := strings.Join(parts[:i], "/") + "/"
+		if _, ok := files[dir]; ok {
+			return dir
+		}
+	}
+
+	return ""
+}
+
+// scanSourceDir updates files with the current state of the source
+// directory and hydrates any backup that hasn't changed for the settle
+// time using f, recording it in j.
+func scanSourceDir(f *filler.Filler, j *journal.Journal, files map[string]*watchedFile, settle time.Duration) {
+	infos, err := readLocalSourceDir()
+	if err != nil {
+		logger.Err.WithError(err).Errorf("Unable to read directory %s", config.Config.SourceBackupDir)
+		return
+	}
+
+	now := time.Now()
+	seen := map[string]bool{}
+
+	for filename, info := range infos {
+		seen[filename] = true
+
+		file, ok := files[filename]
+		if !ok || file.size != info.Size || !file.modTime.Equal(info.ModTime) {
+			// new or changed file; wait for it to settle
+			files[filename] = &watchedFile{
+				size:       info.Size,
+				modTime:    info.ModTime,
+				lastChange: now,
+			}
+			continue
+		}
+
+		if file.done || now.Sub(file.lastChange) < settle || now.Before(file.retryAt) {
+			continue
+		}
+
+		sourceFile := storage.Join(config.Config.SourceBackupDir, filename)
+		dest := storage.Join(config.Config.DestBackupDir, destName(filename))
+
+		log := logger.Err.WithField("backup", sourceFile)
+
+		skip, err := skipReason(j, filename, sourceFile, dest)
+		if err != nil {
+			log.WithError(err).Error("Unable to decide whether to process backup")
+			continue
+		}
+		file.done = true
+		if skip != "" {
+			log.Infof("%s, skipping", skip)
+			continue
+		}
+
+		err = hydrateJournaled(f, j, filename, sourceFile, dest)
+		if source.IsPending(err) {
+			log.WithError(err).Warnf("Backup deferred, will retry in %v", deferredRetryInterval)
+			file.done = false
+			file.retryAt = now.Add(deferredRetryInterval)
+		} else if source.IsCircuitOpen(err) {
+			log.WithError(err).Fatal("Content source is down, stopping")
+		} else if moodle.IsNotBackup(err) {
+			log.WithError(err).Warn("Skipping file that isn't a Moodle backup")
+		} else if err != nil {
+			log.WithError(err).Error("Unable to fill backup, will retry if it changes")
+		}
+	}
+
+	// forget files that have been removed from the source directory
+	for filename := range files {
+		if !seen[filename] {
+			delete(files, filename)
+		}
+	}
+}
+
+// vim: nolist expandtab ts=4 sw=4